@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// named albums of files from any directory, without copying
+// stored in the cache directory per indexed root, keyed by root-relative (slash separated) path
+
+var albums *albumStore
+
+type albumStore struct {
+	mu     sync.Mutex
+	path   string
+	albums map[string][]string // name -> root-relative paths
+}
+
+type albumInfo struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// one file per root
+func loadAlbums(cache, root string) *albumStore {
+	sum := sha1.Sum([]byte(root))
+	s := &albumStore{path: filepath.Join(cache, "albums-"+hex.EncodeToString(sum[:4])+".json"), albums: make(map[string][]string)}
+
+	if buf, err := os.ReadFile(s.path); err == nil {
+		json.Unmarshal(buf, &s.albums)
+	}
+	return s
+}
+
+func (s *albumStore) save() error {
+	buf, err := json.MarshalIndent(s.albums, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, buf, 0644)
+}
+
+func (s *albumStore) list() []albumInfo {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]albumInfo, 0, len(s.albums))
+	for name, paths := range s.albums {
+		list = append(list, albumInfo{name, len(paths)})
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+	return list
+}
+
+func (s *albumStore) entries(name string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, ok := s.albums[name]
+	return append([]string(nil), paths...), ok
+}
+
+// adds (in order, without duplicates) or removes paths; an emptied album is deleted
+func (s *albumStore) update(name string, paths []string, add bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur := s.albums[name]
+	if add {
+		for _, p := range paths {
+			if !contains(cur, p) {
+				cur = append(cur, p)
+			}
+		}
+	} else {
+		kept := cur[:0]
+		for _, p := range cur {
+			if !contains(paths, p) {
+				kept = append(kept, p)
+			}
+		}
+		cur = kept
+	}
+
+	if len(cur) == 0 {
+		delete(s.albums, name)
+	} else {
+		s.albums[name] = cur
+	}
+	return s.save()
+}
+
+// follows a moved or renamed file
+func (s *albumStore) rename(from, to string) {
+	from, to = relPath(from), relPath(to)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for name, paths := range s.albums {
+		for i, p := range paths {
+			if p == from {
+				s.albums[name][i] = to
+				changed = true
+			}
+		}
+	}
+	if changed {
+		s.save()
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// root-relative, slash separated
+func relPath(fp string) string {
+	rel, err := filepath.Rel(cfg.root, fp)
+	if err != nil {
+		return filepath.ToSlash(fp)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func validAlbumName(name string) bool {
+	return name != "" && len(name) <= 100 && strings.TrimSpace(name) == name && !strings.ContainsAny(name, `/\`)
+}
+
+type albumRequest struct {
+	IDs   []int    `json:"ids"`
+	Paths []string `json:"paths"` // root-relative, for missing files
+}
+
+// GET /album/{name}: grid page
+// POST /album/{name}/add, /album/{name}/remove
+func albumHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/album/")
+
+	if r.Method == http.MethodPost {
+		if !checkPost(w, r) {
+			return
+		}
+		name, op, _ := strings.Cut(name, "/")
+		if !validAlbumName(name) || (op != "add" && op != "remove") {
+			http.Error(w, "Invalid album", http.StatusBadRequest)
+			return
+		}
+
+		var req albumRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		paths := req.Paths
+		for _, id := range req.IDs {
+			if fi, ok := indexedFile(id); ok {
+				paths = append(paths, relPath(fi.Path))
+			}
+		}
+
+		if err := albums.update(name, paths, op == "add"); err != nil {
+			http.Error(w, "Unable to save album: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	paths, ok := albums.entries(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// resolve against the index; files gone since are listed as missing
+	byPath := make(map[string]FileInfo)
+	for _, itm := range displayOrder() {
+		if itm.isFile {
+			byPath[relPath(itm.Path)] = itm
+		}
+	}
+
+	writePageHead(w, r, name, name)
+	fmt.Fprintf(w, `<ul class="stretch"><li><div class="album-title"><span>%s</span></div></li></ul><ul class="flex">`, html.EscapeString(name))
+	for _, p := range paths {
+		if itm, ok := byPath[p]; ok {
+			writeTile(w, itm)
+		} else {
+			fmt.Fprintf(w, `<li class="missing" data-path="%s"><img src="/static/placeholder.svg" title="%s (missing)" /><span class="name">%s</span></li>`, html.EscapeString(p), html.EscapeString(p), html.EscapeString(filepath.Base(p)))
+		}
+	}
+	fmt.Fprint(w, `</ul></body></html>`)
+}
+
+func albumsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(albums.list())
+}
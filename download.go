@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /download?ids=1,2,..|dir={id}|album={name}[&resized=1&preset={name}&name={zip name}]
+// streams a zip built on the fly, originals or jpeg per preset; POST (form) for large selections
+// entries are stored (not deflated), named by root-relative path; failures are listed in errors.txt
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+
+	var files []FileInfo
+	name := "thumbnailer"
+
+	switch {
+	case q.Get("ids") != "":
+		for _, s := range strings.Split(q.Get("ids"), ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil { continue }
+			if fi, ok := indexedFile(id); ok {
+				files = append(files, fi)
+			}
+		}
+	case q.Get("dir") != "":
+		id, err := strconv.Atoi(q.Get("dir"))
+		dir, ok := indexedDir(id)
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		prefix := dir.Path + string(os.PathSeparator)
+		for _, itm := range displayOrder() {
+			if itm.isFile && strings.HasPrefix(itm.Path, prefix) {
+				files = append(files, itm)
+			}
+		}
+		name = path.Base(relPath(dir.Path))
+	case q.Get("album") != "":
+		paths, ok := albums.entries(q.Get("album"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		byPath := make(map[string]FileInfo)
+		for _, itm := range displayOrder() {
+			if itm.isFile {
+				byPath[relPath(itm.Path)] = itm
+			}
+		}
+		for _, p := range paths {
+			if itm, ok := byPath[p]; ok {
+				files = append(files, itm)
+			}
+		}
+		name = q.Get("album")
+	}
+	if len(files) == 0 {
+		http.Error(w, "Nothing to download", http.StatusNotFound)
+		return
+	}
+
+	resized := q.Get("resized") != ""
+	o := DecodeOpts{Format: "jpeg", Retry: true}
+	if resized {
+		_, preset := clientPreset(r)
+		o.Fit = lightboxFit(preset, nil)
+		o.Quality = preset.quality
+		resized = o.Fit.Width > 0 // no preset (none): nothing to resize to, the originals are zipped
+	}
+
+	if n := q.Get("name"); n != "" { name = n }
+	name = strings.Map(func(c rune) rune {
+		if strings.ContainsRune(`"/\`, c) { return -1 }
+		return c
+	}, name)
+	if name == "." || name == "" { name = "thumbnailer" }
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+
+	zw := zip.NewWriter(w)
+	used := make(map[string]bool)
+	var failed []string
+
+	for _, itm := range files {
+		if r.Context().Err() != nil {
+			return // client is gone
+		}
+
+		var err error
+		if resized && itm.cType != "doc" {
+			err = zipResized(zw, itm, o, used, r)
+		} else {
+			err = zipOriginal(zw, itm, used)
+		}
+		if err != nil {
+			slog.Warn("download entry failed", "path", itm.Path, "err", err)
+			failed = append(failed, fmt.Sprintf("%s: %v", relPath(itm.Path), err))
+		}
+	}
+
+	if len(failed) > 0 {
+		if f, err := zw.Create("errors.txt"); err == nil {
+			io.WriteString(f, strings.Join(failed, "\n")+"\n")
+		}
+	}
+	zw.Close()
+}
+
+// unique entry name, with a counter before the extension
+func zipName(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[name] = true
+	return name
+}
+
+func zipOriginal(zw *zip.Writer, itm FileInfo, used map[string]bool) error {
+	f, err := os.Open(itm.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr := &zip.FileHeader{Name: zipName(relPath(itm.Path), used), Method: zip.Store, Modified: fi.ModTime()}
+	zf, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(zf, f)
+	return err
+}
+
+// decoded through the scheduler like the lightbox image
+func zipResized(zw *zip.Writer, itm FileInfo, o DecodeOpts, used map[string]bool, r *http.Request) error {
+	id := itm.ID
+	if rotations != nil {
+		o.Rotate = rotations.get(itm.Path)
+		if o.Rotate % 180 != 0 {
+			o.Fit.Width, o.Fit.Height = o.Fit.Height, o.Fit.Width
+		}
+	}
+
+	buf, ct, err := imageFlight.do(r.Context(), imageKey(id, o), func(ctx context.Context) ([]byte, string, error) {
+		return decode(ctx, id, "image", o)
+	})
+	if err != nil {
+		return err
+	}
+	if buf == nil { // served as is
+		return zipOriginal(zw, itm, used)
+	}
+
+	// encoded as jpeg, or png with -alpha keep; svg and small files are passed through unchanged
+	rel := relPath(itm.Path)
+	ext := path.Ext(rel)
+	for f, e := range encoders {
+		if e.mime == ct {
+			ext = "." + f
+		}
+	}
+	if ext == ".jpeg" { ext = ".jpg" }
+	name := strings.TrimSuffix(rel, path.Ext(rel)) + ext
+	hdr := &zip.FileHeader{Name: zipName(name, used), Method: zip.Store, Modified: time.Now()}
+	if fi, err := os.Stat(itm.Path); err == nil { hdr.Modified = fi.ModTime() }
+	zf, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = zf.Write(buf)
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"expvar"
+	"os"
+	"time"
+
+	"thumbnailer/vips"
+)
+
+// fast grid mode (-fast)
+// thumbnails from the exif (ifd1) thumbnail of jpeg or the heif thumbnail image,
+// if at least as wide as requested
+
+var (
+	// exposed via /metrics (-metrics) and /debug/vars (-pprof)
+	embeddedHits   = expvar.NewInt("thumbnail_embedded")
+	embeddedMisses = expvar.NewInt("thumbnail_embedded_miss")
+)
+
+func getEmbeddedThumbnail(fp string, fi *FileInfo, o DecodeOpts) ([]byte, string, error) {
+	start := time.Now()
+	var buf []byte
+	var ct string
+	var err error
+
+	switch normExt(fp) {
+	case "jpg", "jpeg":
+		buf, ct, err = getExifThumbnail(fp, fi, o)
+	case "heic":
+		buf, ct, err = getHeifThumbnail(fp, fi, o)
+	default:
+		return nil, "", errNoPreview
+	}
+	observeDecode("embedded", normExt(fp), start)
+
+	if err != nil {
+		observeEmbedded(false)
+		return nil, "", err
+	}
+	observeEmbedded(true)
+	return buf, ct, nil
+}
+
+func getExifThumbnail(fp string, fi *FileInfo, o DecodeOpts) ([]byte, string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	t, err := jpegExif(f)
+	if err != nil {
+		return nil, "", err
+	}
+	_, next, err := t.readIFD(t.ifd0)
+	if err != nil || next == 0 {
+		return nil, "", errNoPreview
+	}
+	entries, _, err := t.readIFD(next) // ifd1
+	if err != nil {
+		return nil, "", errNoPreview
+	}
+
+	jo, ok1 := t.int(entries, tagJpegOffset)
+	jl, ok2 := t.int(entries, tagJpegLength)
+	if !ok1 || !ok2 || jl <= 0 || jl > 1 << 20 {
+		return nil, "", errNoPreview
+	}
+
+	w, h, ok := jpegSize(f, t.base + jo)
+	if !ok {
+		return nil, "", errNoPreview
+	}
+	orient, _ := t.orientation()
+	if orient >= 5 { w, h = h, w }
+	if w < o.Width {
+		return nil, "", errNoPreview
+	}
+
+	p := &jpegPreview{buf: make([]byte, jl), orient: orient, width: w, height: h}
+	if _, err := f.ReadAt(p.buf, t.base + jo); err != nil {
+		return nil, "", err
+	}
+
+	// main image dimensions for the resize trigger
+	if mw, mh, ok := jpegSize(f, 0); ok {
+		fi.mpx = float64(mw * mh) / 1000000.0
+	}
+
+	return previewImage(p, true, o)
+}
+
+func getHeifThumbnail(fp string, fi *FileInfo, o DecodeOpts) ([]byte, string, error) {
+	// peek
+	_img, err := vips.NewImageFromFile(fp, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	fi.mpx = float64(_img.Width() * _img.Height()) / 1000000.0
+	_img.Close()
+
+	img, err := vips.NewHeifload(fp, &vips.HeifloadOptions{ Thumbnail: true })
+	if err != nil {
+		return nil, "", err
+	}
+	defer img.Close()
+
+	// without a thumbnail image, libheif decodes the primary image
+	if img.Width() < o.Width || float64(img.Width() * img.Height()) / 1000000.0 >= fi.mpx {
+		return nil, "", errNoPreview
+	}
+
+	width, height, crop := thumbBox(o)
+	if err := img.ThumbnailImage(width, &vips.ThumbnailImageOptions{ Height: height, Crop: crop }); err != nil {
+		return nil, "", err
+	}
+
+	return encode(img, o)
+}
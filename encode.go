@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"thumbnailer/vips"
+)
+
+type Encoder struct {
+	mime    string
+	quality int
+	effort  int
+}
+
+var encoders = map[string]*Encoder{
+	"jpeg": {mime: "image/jpeg", quality: 85},
+	"webp": {mime: "image/webp", quality: 80, effort: 4},
+	"avif": {mime: "image/avif", quality: 50, effort: 4},
+	"jxl" : {mime: "image/jxl",  quality: 75, effort: 7},
+	"png" : {mime: "image/png",  effort: 6}, // effort: compression level
+}
+
+// per-request decode parameters
+type DecodeOpts struct {
+	Format  string
+	Quality int  // 0: per format
+	Retry   bool
+	Width   int  // thumbnail width
+	Full    bool // raw: full decode
+	Fit     Fit  // lightbox resize
+	Rotate  int  // clockwise degrees (-rotate sidecar)
+}
+
+// lightbox resize bounds; images above Mpx are fitted within Width x Height
+type Fit struct {
+	Width  int
+	Height int
+	Mpx    float64
+}
+
+// picks the first format of the -format preference list accepted by the client
+// jpeg is the fallback
+func negotiateFormat(accept string) string {
+	for _, f := range cfg.formats {
+		if f == "jpeg" || strings.Contains(accept, encoders[f].mime) {
+			return f
+		}
+	}
+	return "jpeg"
+}
+
+// encodes img per format, auto-rotated and converted to 8-bit srgb
+// sources with an alpha band (png, webp, gif, ..) are handled per -alpha
+// keep: encode with alpha, switching from jpeg to png
+// flatten: onto the -bg colour
+// checker: onto a checkerboard
+func encode(img *vips.Image, o DecodeOpts) ([]byte, string, error) {
+	format := o.Format
+
+	// upright per exif orientation; a no-op for thumbnails, rotated on load
+	if err := img.Autorot(nil); err != nil {
+		return nil, "", err
+	}
+	if err := rotateImage(img, o.Rotate); err != nil {
+		return nil, "", err
+	}
+	if err := toSrgb(img); err != nil {
+		return nil, "", err
+	}
+
+	if img.HasAlpha() {
+		switch cfg.alpha {
+		case "flatten", "checker":
+			if img.Bands() < 3 { // grey
+				if err := img.Colourspace(vips.InterpretationSrgb, nil); err != nil {
+					return nil, "", err
+				}
+			}
+			if cfg.alpha == "checker" {
+				bg, err := checkerboard(img.Width(), img.Height())
+				if err != nil {
+					return nil, "", err
+				}
+				defer bg.Close()
+
+				if err := bg.Composite2(img, vips.BlendModeOver, nil); err != nil {
+					return nil, "", err
+				}
+				img = bg
+			}
+			if err := img.Flatten(&vips.FlattenOptions{ Background: cfg.bg }); err != nil {
+				return nil, "", err
+			}
+		default:
+			if format == "jpeg" { format = "png" }
+		}
+	}
+
+	e, ok := encoders[format]
+	if !ok {
+		format, e = "jpeg", encoders["jpeg"]
+	}
+	q := e.quality
+	if o.Quality > 0 { q = o.Quality }
+
+	var buf []byte
+	var err error
+
+	// metadata other than the colour profile is irrelevant for display
+	keep := vips.KeepIcc
+	if cfg.icc == "strip" {
+		keep = vips.KeepNone
+	}
+
+	switch format {
+	case "webp":
+		buf, err = img.WebpsaveBuffer(&vips.WebpsaveBufferOptions{ Q: q, Effort: e.effort, Keep: keep })
+	case "avif":
+		buf, err = img.HeifsaveBuffer(&vips.HeifsaveBufferOptions{ Q: q, Effort: e.effort, Compression: vips.HeifCompressionAv1, Keep: keep })
+	case "jxl":
+		buf, err = img.JxlsaveBuffer(&vips.JxlsaveBufferOptions{ Q: q, Effort: e.effort, Keep: keep })
+	case "png":
+		buf, err = img.PngsaveBuffer(&vips.PngsaveBufferOptions{ Compression: e.effort, Keep: keep })
+	default:
+		buf, err = img.JpegsaveBuffer(&vips.JpegsaveBufferOptions{ Q: q, Keep: keep })
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf, e.mime, nil
+}
+
+// parses the -format preference list
+func parseFormats(s string) ([]string, error) {
+	var formats []string
+	for _, f := range strings.Split(strings.ToLower(s), ",") {
+		f = strings.TrimSpace(f)
+		if f == "jpg" { f = "jpeg" }
+		if _, ok := encoders[f]; !ok {
+			return nil, fmt.Errorf("unknown format: %s", f)
+		}
+		formats = append(formats, f)
+	}
+	return formats, nil
+}
+
+// parses per-format settings such as "webp=80,avif=50" via set
+func parseFormatInts(s string, set func(*Encoder, int)) error {
+	if s == "" {
+		return nil
+	}
+	for _, kv := range strings.Split(strings.ToLower(s), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if k == "jpg" { k = "jpeg" }
+		e, known := encoders[k]
+		if !ok || !known {
+			return fmt.Errorf("invalid format setting: %s", kv)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid format setting: %s", kv)
+		}
+		set(e, n)
+	}
+	return nil
+}
+
+// colour management
+// images with an embedded profile and cmyk (with a generic profile if none) are converted to srgb,
+// 16-bit is reduced to 8-bit, float (hdr) is normalised to its peak before
+func toSrgb(img *vips.Image) error {
+	interp := img.Interpretation()
+
+	if interp == vips.InterpretationCmyk || img.HasICCProfile() {
+		opts := &vips.IccTransformOptions{ Intent: vips.IntentPerceptual, Embedded: true, Depth: 8 }
+		if interp == vips.InterpretationCmyk {
+			opts.InputProfile = "cmyk"
+		}
+		return img.IccTransform("srgb", opts)
+	}
+
+	switch interp {
+	case vips.InterpretationScrgb:
+		if peak, err := img.Max(); err == nil && peak > 1 {
+			if err := img.Linear([]float64{1 / peak}, []float64{0}, nil); err != nil {
+				return err
+			}
+		}
+		return img.Colourspace(vips.InterpretationSrgb, nil)
+	case vips.InterpretationRgb16, vips.InterpretationGrey16:
+		return img.Colourspace(vips.InterpretationSrgb, nil)
+	}
+	return nil
+}
+
+// opaque checkerboard backdrop for transparent images
+// a single tile of 2x2 squares, repeated by libvips to the image size
+func checkerboard(w, h int) (*vips.Image, error) {
+	const size = 8
+	light := color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+	dark  := color.RGBA{0x99, 0x99, 0x99, 0xff}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, 2 * size, 2 * size))
+	for y := 0; y < 2 * size; y++ {
+		for x := 0; x < 2 * size; x++ {
+			if (x/size + y/size) % 2 == 0 {
+				rgba.SetRGBA(x, y, light)
+			} else {
+				rgba.SetRGBA(x, y, dark)
+			}
+		}
+	}
+	tile, err := vips.NewImageFromMemory(rgba.Pix, 2 * size, 2 * size, 4)
+	if err != nil {
+		return nil, err
+	}
+	if err := tile.Embed(0, 0, w, h, &vips.EmbedOptions{ Extend: vips.ExtendRepeat }); err != nil {
+		tile.Close()
+		return nil, err
+	}
+	return tile, nil
+}
+
+// content type of a file or buffer served as is, "" if unknown
+func sniffType(buf []byte) string {
+	ct := http.DetectContentType(buf)
+	if !strings.HasPrefix(ct, "image/") {
+		return ""
+	}
+	return ct
+}
+
+// parses a "#rrggbb" colour
+func parseColour(s string) ([]float64, error) {
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(strings.TrimPrefix(s, "#"), "%02x%02x%02x", &r, &g, &b); err != nil {
+		return nil, fmt.Errorf("invalid colour: %s", s)
+	}
+	return []float64{float64(r), float64(g), float64(b)}, nil
+}
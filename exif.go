@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// minimal tiff / exif / jpeg structure parsing
+// used to locate embedded previews in raw containers and jpeg files
+
+const (
+	tagCompression  = 0x0103
+	tagStripOffsets = 0x0111
+	tagOrientation  = 0x0112
+	tagStripCounts  = 0x0117
+	tagSubIFDs      = 0x014a
+	tagJpegOffset   = 0x0201
+	tagJpegLength   = 0x0202
+	tagRw2JpgFromRaw = 0x002e
+)
+
+var (
+	errNoPreview    = errors.New("no embedded preview")
+	errPreviewSmall = errors.New("embedded preview too small")
+)
+
+type tiffReader struct {
+	r    io.ReaderAt
+	base int64 // offset of the tiff header
+	bo   binary.ByteOrder
+	ifd0 int64
+}
+
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value [4]byte
+}
+
+// location of an embedded jpeg
+type jpegRef struct {
+	off    int64
+	length int64
+}
+
+// parses the tiff header at base; accepts the raw variants (orf, rw2) with a non-standard magic
+func newTiffReader(r io.ReaderAt, base int64) (*tiffReader, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], base); err != nil {
+		return nil, err
+	}
+
+	t := &tiffReader{r: r, base: base}
+	switch string(hdr[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil, errors.New("not a tiff structure")
+	}
+	t.ifd0 = int64(t.bo.Uint32(hdr[4:]))
+	return t, nil
+}
+
+func (t *tiffReader) readIFD(off int64) ([]ifdEntry, int64, error) {
+	var n [2]byte
+	if _, err := t.r.ReadAt(n[:], t.base+off); err != nil {
+		return nil, 0, err
+	}
+	count := int(t.bo.Uint16(n[:]))
+	if count == 0 || count > 1000 {
+		return nil, 0, errors.New("invalid ifd")
+	}
+
+	buf := make([]byte, count*12+4)
+	if _, err := t.r.ReadAt(buf, t.base+off+2); err != nil {
+		return nil, 0, err
+	}
+
+	entries := make([]ifdEntry, count)
+	for i := range entries {
+		b := buf[i*12:]
+		entries[i] = ifdEntry{tag: t.bo.Uint16(b), typ: t.bo.Uint16(b[2:]), count: t.bo.Uint32(b[4:])}
+		copy(entries[i].value[:], b[8:12])
+	}
+	return entries, int64(t.bo.Uint32(buf[count*12:])), nil
+}
+
+// integer values of a short or long entry
+func (t *tiffReader) ints(e ifdEntry) []int64 {
+	size := 4
+	if e.typ == 3 { // short
+		size = 2
+	} else if e.typ != 4 && e.typ != 13 { // long, ifd
+		return nil
+	}
+	if e.count == 0 || e.count > 1024 {
+		return nil
+	}
+
+	buf := e.value[:]
+	if int(e.count)*size > 4 {
+		buf = make([]byte, int(e.count)*size)
+		if _, err := t.r.ReadAt(buf, t.base+int64(t.bo.Uint32(e.value[:]))); err != nil {
+			return nil
+		}
+	}
+
+	vals := make([]int64, e.count)
+	for i := range vals {
+		if size == 2 {
+			vals[i] = int64(t.bo.Uint16(buf[i*2:]))
+		} else {
+			vals[i] = int64(t.bo.Uint32(buf[i*4:]))
+		}
+	}
+	return vals
+}
+
+func (t *tiffReader) int(entries []ifdEntry, tag uint16) (int64, bool) {
+	for _, e := range entries {
+		if e.tag == tag {
+			if v := t.ints(e); len(v) > 0 {
+				return v[0], true
+			}
+		}
+	}
+	return 0, false
+}
+
+// orientation tag of ifd0, (1, false) if absent
+func (t *tiffReader) orientation() (int, bool) {
+	entries, _, err := t.readIFD(t.ifd0)
+	if err != nil {
+		return 1, false
+	}
+	if v, ok := t.int(entries, tagOrientation); ok && v >= 1 && v <= 8 {
+		return int(v), true
+	}
+	return 1, false
+}
+
+// absolute offset and value of the ifd0 orientation tag
+func (t *tiffReader) orientationEntry() (int64, int, bool) {
+	entries, _, err := t.readIFD(t.ifd0)
+	if err != nil {
+		return 0, 0, false
+	}
+	for i, e := range entries {
+		if e.tag == tagOrientation && e.typ == 3 && e.count == 1 {
+			v := int(t.bo.Uint16(e.value[:]))
+			if v < 1 || v > 8 {
+				return 0, 0, false
+			}
+			return t.base + t.ifd0 + 2 + int64(i)*12 + 8, v, true
+		}
+	}
+	return 0, 0, false
+}
+
+// collects jpeg candidates of the ifd chain starting at off, including sub-ifds
+func (t *tiffReader) jpegs(off int64, depth int) []jpegRef {
+	var refs []jpegRef
+
+	for i := 0; off > 0 && i < 8; i++ {
+		entries, next, err := t.readIFD(off)
+		if err != nil {
+			break
+		}
+
+		if jo, ok := t.int(entries, tagJpegOffset); ok {
+			if jl, ok := t.int(entries, tagJpegLength); ok {
+				refs = append(refs, jpegRef{t.base + jo, jl})
+			}
+		}
+		if c, ok := t.int(entries, tagCompression); ok && (c == 6 || c == 7) {
+			for _, e := range entries {
+				if e.tag != tagStripOffsets { continue }
+				offs := t.ints(e)
+				for _, e2 := range entries {
+					if e2.tag != tagStripCounts { continue }
+					if lens := t.ints(e2); len(offs) == 1 && len(lens) == 1 {
+						refs = append(refs, jpegRef{t.base + offs[0], lens[0]})
+					}
+				}
+			}
+		}
+		for _, e := range entries {
+			switch {
+			case e.tag == tagRw2JpgFromRaw && e.typ == 7: // undefined
+				refs = append(refs, jpegRef{t.base + int64(t.bo.Uint32(e.value[:])), int64(e.count)})
+			case e.tag == tagSubIFDs && depth < 2:
+				for _, sub := range t.ints(e) {
+					refs = append(refs, t.jpegs(sub, depth+1)...)
+				}
+			}
+		}
+		off = next
+	}
+	return refs
+}
+
+// dimensions of a baseline or progressive jpeg
+// lossless jpeg (raw sensor data in dng and others) is rejected
+func jpegSize(r io.ReaderAt, off int64) (int, int, bool) {
+	var b [9]byte
+	if _, err := r.ReadAt(b[:2], off); err != nil || b[0] != 0xff || b[1] != 0xd8 {
+		return 0, 0, false
+	}
+
+	pos := off + 2
+	for i := 0; i < 64; i++ {
+		if _, err := r.ReadAt(b[:4], pos); err != nil || b[0] != 0xff {
+			return 0, 0, false
+		}
+		marker := b[1]
+		length := int64(binary.BigEndian.Uint16(b[2:]))
+
+		switch marker {
+		case 0xc0, 0xc1, 0xc2:
+			if _, err := r.ReadAt(b[:], pos+4); err != nil {
+				return 0, 0, false
+			}
+			h := int(binary.BigEndian.Uint16(b[1:]))
+			w := int(binary.BigEndian.Uint16(b[3:]))
+			return w, h, w > 0 && h > 0
+		case 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf, 0xda:
+			return 0, 0, false
+		}
+		pos += 2 + length
+	}
+	return 0, 0, false
+}
+
+// exif (tiff) structure of a jpeg, from its app1 segment
+func jpegExif(r io.ReaderAt) (*tiffReader, error) {
+	var b [10]byte
+	if _, err := r.ReadAt(b[:2], 0); err != nil || b[0] != 0xff || b[1] != 0xd8 {
+		return nil, errors.New("not a jpeg")
+	}
+
+	pos := int64(2)
+	for i := 0; i < 32; i++ {
+		if _, err := r.ReadAt(b[:], pos); err != nil || b[0] != 0xff {
+			break
+		}
+		marker := b[1]
+		length := int64(binary.BigEndian.Uint16(b[2:]))
+
+		if marker == 0xe1 && bytes.Equal(b[4:10], []byte("Exif\x00\x00")) {
+			return newTiffReader(r, pos+10)
+		}
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		pos += 2 + length
+	}
+	return nil, errors.New("no exif")
+}
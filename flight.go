@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+)
+
+var (
+	// exposed via /metrics (-metrics) and /debug/vars (-pprof)
+	decodeRuns = expvar.NewMap("decode_runs")
+	coalesced  = expvar.NewMap("decode_coalesced")
+)
+
+// in-flight deduplication of identical decode requests
+// concurrent callers with the same key share a single run
+type flight struct {
+	name  string
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	buf  []byte
+	ct   string
+	err  error
+}
+
+func newFlight(name string) *flight {
+	return &flight{name: name, calls: make(map[string]*flightCall)}
+}
+
+func (g *flight) do(ctx context.Context, key string, fn func(context.Context) ([]byte, string, error)) ([]byte, string, error) {
+	counted := false
+	for {
+		g.mu.Lock()
+		if c, ok := g.calls[key]; ok {
+			g.mu.Unlock()
+			if !counted {
+				coalesced.Add(g.name, 1)
+				counted = true
+			}
+
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+
+			// the leading client left before decoding; take over
+			if isCanceled(c.err) && ctx.Err() == nil {
+				continue
+			}
+			return c.buf, c.ct, c.err
+		}
+
+		c := &flightCall{done: make(chan struct{})}
+		g.calls[key] = c
+		g.mu.Unlock()
+
+		decodeRuns.Add(g.name, 1)
+		c.buf, c.ct, c.err = fn(ctx)
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+
+		return c.buf, c.ct, c.err
+	}
+}
+
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// leveled logging via log/slog (-log-level, -log-format, -log-file)
+// stderr per default; a log file keeps the terminal to the spinner and the address
+func setupLogging(level, format, file string) (io.Closer, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level: %s", level)
+	}
+
+	var out io.Writer = os.Stderr
+	var closer io.Closer
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(out, opts)
+	case "json":
+		h = slog.NewJSONHandler(out, opts)
+	default:
+		if closer != nil { closer.Close() }
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	if cfg.worker {
+		h = h.WithAttrs([]slog.Attr{slog.Int("worker", os.Getpid())})
+	}
+	slog.SetDefault(slog.New(h))
+	return closer, nil
+}
+
+// one line per request (-access-log)
+func accessLog(r *http.Request, handler string, code int, size int64, start time.Time) {
+	slog.Info("request",
+		"handler", handler,
+		"method", r.Method,
+		"path", r.URL.RequestURI(),
+		"status", code,
+		"bytes", size,
+		"duration", time.Since(start),
+		"remote", r.RemoteAddr,
+	)
+}
@@ -3,15 +3,20 @@ package main
 import (
 	"embed"
 	"archive/zip"
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
 	"os"
 	"os/exec"
@@ -54,6 +59,14 @@ var (
 	mu sync.Mutex
 	fileInfos []FileInfo
 
+	sched *scheduler
+	pool  *workerPool
+	quarantine *quarantineList
+	rotations  *rotationList // nil unless -rotate
+
+	thumbFlight = newFlight("thumbnail")
+	imageFlight = newFlight("image")
+
 	fileFormats = map[string]string{
 		"avif": "img",
 		"bmp" : "img",
@@ -111,37 +124,70 @@ var (
 		"x3f" : "raw",
 	}
 
-	vipsJpegO = &vips.JpegsaveBufferOptions{ Q: 85, }
-
 	// refer to resize trigger in imageHandler()
+	// extended by user-defined presets (-presets)
 	Presets = map[string]Preset{
 		"none": {enabled: false, width: 0},
-		"hd"  : {enabled: true,  width: 1920},
-		"4k"  : {enabled: true,  width: 3840},
+		"hd"  : {enabled: true,  width: 1920, height: 1920, mpx: resizeMinMpx},
+		"4k"  : {enabled: true,  width: 3840, height: 3840, mpx: resizeMinMpx},
 	}
 )
 
 type Preset struct {
 	enabled bool
 	width   int
+	height  int
+	mpx     float64 // resize trigger
+	quality int     // 0: per format
+	format  string  // "": negotiated
 }
 
 type Config struct {
+	accessLog bool
+	alpha   string
+	bg      []float64
+	cache   string
 	cd		bool
+	crop    string
+	drain   time.Duration
+	fast    bool
+	fifo    bool
 	fit		bool
+	icc     string
+	interval time.Duration
 	flat    bool
+	formats []string
 	ip      string
+	jobs    uint
 	lsd     bool
+	manage  bool
+	maxFails uint
+	metrics bool
 	open	bool
+	pageSize uint
 	port    uint
+	pprof   bool
 	pstr    string
+	root    string
+	raw     string
 	resize  Preset
+	rotate  string
 	sa      bool
 	sd      bool
 	sh      bool
+	single  bool
+	slideshow bool
+	sizes   []int
+	th      uint
+	thumbMode string
+	timeout time.Duration
 	verbose bool
+	viewport bool
 	version bool
 	width   uint
+	worker  bool
+	workers uint
+	xmp     bool
 }
 
 type ContextData struct {
@@ -154,9 +200,15 @@ type FileInfo struct {
 	cPage   int
 	modTime	int64
 	mpx     float64
+	transcode int8 // lightbox: 1 normalised, -1 served as is, 0 not peeked yet
 	cType	string
 	Path    string
 	Name    string
+	dir     int  // containing directory entry, runtime additions only
+	removed bool // trashed or moved (-manage)
+	rating  int  // -xmp
+	label   string
+	tags    []string
 }
 
 type EpubItem struct {
@@ -194,9 +246,11 @@ func normExt(path string) string {
 	return ext
 }
 
-func walkDir(root string, d chan struct{}) (uint, error) {
+// walks root in display order; progress (if any) is called once per directory with files
+func walkDir(root string, d chan struct{}, progress func([]FileInfo, uint)) ([]FileInfo, uint, error) {
 	var (
 		walk    func(string) error
+		infos   []FileInfo
 		idx     int = -1
 		dcnt    uint = 0
 		modTime int64
@@ -211,6 +265,15 @@ func walkDir(root string, d chan struct{}) (uint, error) {
 		var dirs []FileInfo
 		var files []FileInfo
 
+		// sidecar lookup without a stat per file
+		var names map[string]bool
+		if cfg.xmp {
+			names = make(map[string]bool, len(dirEntries))
+			for _, entry := range dirEntries {
+				names[strings.ToLower(entry.Name())] = true
+			}
+		}
+
 		for _, entry := range dirEntries {
 			fullPath := filepath.Join(path, entry.Name())
 			if entry.IsDir() {
@@ -225,7 +288,12 @@ func walkDir(root string, d chan struct{}) (uint, error) {
 					fi, _ := os.Stat(fullPath)
 					modTime = fi.ModTime().Unix()
 				}
-				files = append(files, FileInfo{Path: fullPath, Name: entry.Name(), isFile: true, cType: cType, cPage: 0, modTime: modTime})
+				file := FileInfo{Path: fullPath, Name: entry.Name(), isFile: true, cType: cType, cPage: 0, modTime: modTime}
+				if cfg.xmp {
+					m := readMeta(fullPath, names)
+					file.rating, file.label, file.tags = m.Rating, m.Label, m.Tags
+				}
+				files = append(files, file)
 			}
 		}
 
@@ -243,12 +311,15 @@ func walkDir(root string, d chan struct{}) (uint, error) {
 			}
 			 idx++
 			dcnt++
-			fileInfos = append(fileInfos, FileInfo{ID: idx, Path: path, Name: "", isFile: false})
+			infos = append(infos, FileInfo{ID: idx, Path: path, Name: "", isFile: false})
 
 			for _, file := range files {
 				idx++
 				file.ID = idx
-				fileInfos = append(fileInfos, file)
+				infos = append(infos, file)
+			}
+			if progress != nil {
+				progress(infos, dcnt)
 			}
 		}
 
@@ -257,7 +328,8 @@ func walkDir(root string, d chan struct{}) (uint, error) {
 		})
 		for _, dir := range dirs {
 			if err := walk(dir.Path); err != nil {
-				continue // typically "Access denied."
+				slog.Warn("directory skipped", "path", dir.Path, "err", err) // typically "Access denied."
+				continue
 			}
 		}
 		return nil
@@ -265,36 +337,38 @@ func walkDir(root string, d chan struct{}) (uint, error) {
 
 
 	if inf, err := os.Stat(root); err != nil || !inf.IsDir() {
-		return 0, errors.New("invalid path (not a directory)")
+		return nil, 0, errors.New("invalid path (not a directory)")
 	}
 	if err := walk(root); err != nil {
-		return 0, err
+		return nil, 0, err
 	}
 
 	if cfg.flat {
 		if cfg.sh {
-			rand.Shuffle(len(fileInfos), func(i, j int) {
-				fileInfos[i], fileInfos[j] = fileInfos[j], fileInfos[i]
-				fileInfos[i].ID, fileInfos[j].ID = fileInfos[j].ID, fileInfos[i].ID
+			rand.Shuffle(len(infos), func(i, j int) {
+				infos[i], infos[j] = infos[j], infos[i]
+				infos[i].ID, infos[j].ID = infos[j].ID, infos[i].ID
 			})
 			goto _eoflat
 		} else if cfg.sd {
-			sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].modTime > fileInfos[j].modTime })
+			sort.Slice(infos, func(i, j int) bool { return infos[i].modTime > infos[j].modTime })
 		} else if cfg.sa {
-			sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].modTime < fileInfos[j].modTime })
+			sort.Slice(infos, func(i, j int) bool { return infos[i].modTime < infos[j].modTime })
 		} else {
-			sort.Slice(fileInfos, func(i, j int) bool { return strings.ToLower(fileInfos[i].Path) < strings.ToLower(fileInfos[j].Path) })
+			sort.Slice(infos, func(i, j int) bool { return strings.ToLower(infos[i].Path) < strings.ToLower(infos[j].Path) })
 		}
-		for i, _ := range fileInfos {
-			fileInfos[i].ID = i
+		for i, _ := range infos {
+			infos[i].ID = i
 		}
 _eoflat:
 	}
 
-	return dcnt, nil
+	return infos, dcnt, nil
 }
 
 func getEpubCoverImage(fp string) ([]byte, error) {
+	defer observeDecode("epub", "epub", time.Now())
+
 	var coverImageHref string
 
 	var opf  EpubOPF
@@ -423,7 +497,9 @@ func getEpubCoverImage(fp string) ([]byte, error) {
 	return imgBuf, nil
 }
 
-func getVipsPdfImage(pdfPath string, id int) ([]byte, error) {
+func getVipsPdfImage(pdfPath string, fi *FileInfo, o DecodeOpts) ([]byte, string, error) {
+	defer observeDecode("vips", "pdf", time.Now())
+
 	var img *vips.Image
 
 	opts := vips.DefaultPdfloadOptions()
@@ -431,32 +507,30 @@ func getVipsPdfImage(pdfPath string, id int) ([]byte, error) {
 
 	img, err := vips.NewPdfload(pdfPath, opts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer img.Close()
 
-	loadopts := &vips.ThumbnailImageOptions{ Height: 5000, }
-	err = img.ThumbnailImage(int(cfg.width), loadopts)
-	if err != nil {
-		return nil, err
-	}
-
-	thumbnailBuf, err := img.JpegsaveBuffer(vipsJpegO)
+	width, height, crop := thumbBox(o)
+	loadopts := &vips.ThumbnailImageOptions{ Height: height, Crop: crop }
+	err = img.ThumbnailImage(width, loadopts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return thumbnailBuf, nil
+	return encode(img, o)
 }
 
-func getFitzDocImage(fp string, id int) ([]byte, error) {
+func getFitzDocImage(fp string, fi *FileInfo, o DecodeOpts) ([]byte, string, error) {
+	defer observeDecode("fitz", normExt(fp), time.Now())
+
 	var img image.Image
 
 	// https://github.com/gen2brain/go-fitz/issues/4
 	// locking all doc. ops is required
 	doc, err := fitz.New(fp)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	defer func() {
@@ -481,9 +555,9 @@ func getFitzDocImage(fp string, id int) ([]byte, error) {
 				img, err = doc.Image(p)
 				mu.Unlock()
 				if err != nil {
-					return nil, err
+					return nil, "", err
 				}
-				fileInfos[id].cPage = p
+				fi.cPage = p
 				break
 			}
 
@@ -491,7 +565,7 @@ func getFitzDocImage(fp string, id int) ([]byte, error) {
 			img, err = doc.Image(0)
 			mu.Unlock()
 			if err != nil {
-				return nil, err
+				return nil, "", err
 			}
 			break
 		} else {
@@ -506,7 +580,7 @@ func getFitzDocImage(fp string, id int) ([]byte, error) {
 		img, err = doc.Image(0)
 		mu.Unlock()
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 	}
 
@@ -514,20 +588,30 @@ func getFitzDocImage(fp string, id int) ([]byte, error) {
 	rgba := image.NewRGBA(bounds)
 	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
 
-	vi, _ := vips.NewImageFromMemory(rgba.Pix, bounds.Dx(), bounds.Dy(), 4)
+	vi, err := vips.NewImageFromMemory(rgba.Pix, bounds.Dx(), bounds.Dy(), 4)
+	if err != nil {
+		return nil, "", err
+	}
 	defer vi.Close()
 
-	buf, _ := vi.JpegsaveBuffer(vipsJpegO)
+	// opaque; drop the alpha band
+	if err := vi.Flatten(nil); err != nil {
+		return nil, "", err
+	}
 
-	thumbnailBuf, err := getVipsFromBuffer(buf, true)
+	width, height, crop := thumbBox(o)
+	loadopts := &vips.ThumbnailImageOptions{ Height: height, Crop: crop }
+	err = vi.ThumbnailImage(width, loadopts)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return thumbnailBuf, nil
+	return encode(vi, o)
 }
 
 func getMobiCoverImage(fp string) ([]byte, error) {
+	defer observeDecode("mobi", normExt(fp), time.Now())
+
 	m, err := mobi.Open(fp)
 	if err != nil {
 		return nil, err
@@ -542,7 +626,9 @@ func getMobiCoverImage(fp string) ([]byte, error) {
 	return buf, nil
 }
 
-func getVipsFromFile(fp string, id int, thumbnail bool, resize bool) ([]byte, string, error) {
+func getVipsFromFile(fp string, fi *FileInfo, thumbnail bool, resize bool, o DecodeOpts) ([]byte, string, error) {
+	start := time.Now()
+
 	// peek
 	_img, err := vips.NewImageFromFile(fp, nil)
 	if err != nil {
@@ -552,8 +638,12 @@ func getVipsFromFile(fp string, id int, thumbnail bool, resize bool) ([]byte, st
 	w := _img.Width()
 	h := _img.Height()
 	f := _img.Format()
+	defer func() { observeDecode("vips", string(f), start) }()
+	orient := _img.Orientation()
+	cmyk := _img.Interpretation() == vips.InterpretationCmyk
 
-	if thumbnail { fileInfos[id].mpx = float64(w * h) / 1000000.0 }
+	if thumbnail { fi.mpx = float64(w * h) / 1000000.0 }
+	setTranscode(fi, orient, cmyk)
 	_img.Close()
 
 	if f == "svg" {
@@ -561,32 +651,35 @@ func getVipsFromFile(fp string, id int, thumbnail bool, resize bool) ([]byte, st
 		return buf, "image/svg+xml", nil
 	}
 
-	fi, _ := os.Stat(fp)
-	if fi.Size() < thumbMinSize {
+	st, _ := os.Stat(fp)
+	if st.Size() < thumbMinSize && orient <= 1 && !cmyk && o.Rotate == 0 {
 		isComplex := (f == "jxl" || f == "jp2k" || f == "tiff" || f == "heif")
 		if !isComplex {
 			buf, err := os.ReadFile(fp)
-			return buf, "", err
+			return buf, sniffType(buf), err
 		}
 	}
 
 	if thumbnail {
-		w = int(cfg.width)
-	} else if resize {
-		if (h > w) {
-			w = int(float64(cfg.resize.width) / float64(h) * float64(w))
-		} else {
-			w = cfg.resize.width
-		}
+		w = o.Width
+	} else if resize { // fit within o.Fit
+		w = o.Fit.Width
 	} else { // retry (without resize)
 		w = 0
 	}
 
 	var img *vips.Image
 
-	if w > 0 {
-		loadopts := &vips.ThumbnailOptions{ Height: 5000 }
+	if thumbnail {
+		width, height, crop := thumbBox(o)
+		loadopts := &vips.ThumbnailOptions{ Height: height, Crop: crop }
+		img, err = vips.NewThumbnail(fp, width, loadopts)
+	} else if w > 0 {
+		loadopts := &vips.ThumbnailOptions{ Height: o.Fit.Height, Size: vips.SizeDown }
 		img, err = vips.NewThumbnail(fp, w, loadopts)
+	} else if orient > 1 || o.Rotate != 0 {
+		// random access, rotated by encode(); a quarter turn fails on sequential input
+		img, err = vips.NewImageFromFile(fp, nil)
 	} else {
 		// sequential | https://www.libvips.org/API/8.17/enum.Access.html
 		loadopts := &vips.LoadOptions{ Access: 1 }
@@ -598,68 +691,95 @@ func getVipsFromFile(fp string, id int, thumbnail bool, resize bool) ([]byte, st
 	}
 	defer img.Close()
 
-	thumbnailBuf, err := img.JpegsaveBuffer(vipsJpegO)
-	if err != nil {
-		return nil, "", err
-	}
-
-	return thumbnailBuf, "", nil
+	return encode(img, o)
 }
 
-func getVipsFromBuffer(buf []byte, resize bool) ([]byte, error) {
+func getVipsFromBuffer(buf []byte, resize bool, o DecodeOpts) ([]byte, string, error) {
+	defer observeDecode("vips", "cover", time.Now()) // epub, mobi
 
-	if len(buf) < thumbMinSize {
-		return buf, nil
+	if len(buf) < thumbMinSize && o.Rotate == 0 {
+		return buf, sniffType(buf), nil
 	}
 
 	if resize {
-		loadopts := &vips.ThumbnailBufferOptions{ Height: 5000, }
-		img, err := vips.NewThumbnailBuffer(buf, int(cfg.width), loadopts)
+		width, height, crop := thumbBox(o)
+		loadopts := &vips.ThumbnailBufferOptions{ Height: height, Crop: crop }
+		img, err := vips.NewThumbnailBuffer(buf, width, loadopts)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		defer img.Close()
 
-		thumbnailBuf, err := img.JpegsaveBuffer(vipsJpegO)
-		if err != nil {
-			return nil, err
-		}
-
-		return thumbnailBuf, nil
+		return encode(img, o)
 	}
 
 	img, err := vips.NewImageFromBuffer(buf, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer img.Close()
 
-	thumbnailBuf, err := img.JpegsaveBuffer(vipsJpegO)
+	return encode(img, o)
+}
+
+// exif orientation (1 if unknown) and interpretation of an image file, header only
+// browsers are trusted to honour the exif orientation of jpeg only; normalise others
+// cmyk is always transcoded
+func setTranscode(fi *FileInfo, orient int, cmyk bool) {
+	ext := normExt(fi.Path)
+	fi.transcode = -1
+	if cmyk || (orient > 1 && ext != "jpg" && ext != "jpeg") {
+		fi.transcode = 1
+	}
+}
+
+// header only, for a lightbox request preceding the thumbnail
+func peekImage(fi *FileInfo) {
+	img, err := vips.NewImageFromFile(fi.Path, nil)
 	if err != nil {
-		return nil, err
+		return
 	}
+	defer img.Close()
+	fi.mpx = float64(img.Width() * img.Height()) / 1000000.0
+	setTranscode(fi, img.Orientation(), img.Interpretation() == vips.InterpretationCmyk)
+}
 
-	return thumbnailBuf, nil
+// thumbnail bounding box and crop for width o.Width per -thumb-mode
+// width: fixed width, (almost) unbounded height
+// box: fit inside width x -th
+// square, smart: centre or attention/entropy (-crop) cropped square
+// the box is transposed for a quarter turn (-rotate), applied after thumbnailing
+func thumbBox(o DecodeOpts) (int, int, vips.Interesting) {
+	w, h, crop := o.Width, 5000, vips.InterestingNone
+	switch cfg.thumbMode {
+	case "box":
+		h = int(float64(w) * float64(cfg.th) / float64(cfg.width))
+	case "square":
+		h, crop = w, vips.InterestingCentre
+	case "smart":
+		h, crop = w, vips.InterestingAttention
+		if cfg.crop == "entropy" { crop = vips.InterestingEntropy }
+	}
+	if o.Rotate % 180 != 0 {
+		w, h = h, w
+	}
+	return w, h, crop
 }
 
-func generateThumbnail(id int) ([]byte, string, error) {
-	fp := fileInfos[id].Path
+func generateThumbnail(fi *FileInfo, o DecodeOpts) ([]byte, string, error) {
+	fp := fi.Path
 	ext := strings.ToLower(filepath.Ext(fp))
 
 	var thumbnailBuf []byte
-	var ct string = "image/jpeg"
+	var ct string
 
 	switch ext {
 	case ".epub":
 		buf, err := getEpubCoverImage(fp)
 		if err != nil {
-			thumbnailBuf, err = getFitzDocImage(fp, id)
-			if err != nil {
-				return nil, ct, err
-			}
-			return thumbnailBuf, ct, nil
+			return getFitzDocImage(fp, fi, o)
 		}
-		thumbnailBuf, err = getVipsFromBuffer(buf, true)
+		thumbnailBuf, ct, err = getVipsFromBuffer(buf, true, o)
 		if err != nil {
 			return nil, ct, err
 		}
@@ -667,27 +787,35 @@ func generateThumbnail(id int) ([]byte, string, error) {
 	case ".mobi", ".azw3", ".azw", ".azw4", ".pdb", ".prc":
 		buf, err := getMobiCoverImage(fp)
 		if err != nil {
-			thumbnailBuf, err = getFitzDocImage(fp, id)
-			if err != nil {
-				return nil, ct, err
-			} 
-			return thumbnailBuf, ct, nil
+			return getFitzDocImage(fp, fi, o)
 		}
-		thumbnailBuf, err = getVipsFromBuffer(buf, true)
+		thumbnailBuf, ct, err = getVipsFromBuffer(buf, true, o)
 		if err != nil {
 			return nil, ct, err
 		}
 
 	case ".pdf":
 		var err error
-		thumbnailBuf, err = getVipsPdfImage(fp, id)
+		thumbnailBuf, ct, err = getVipsPdfImage(fp, fi, o)
 		if err != nil {
 			return nil, ct, err
 		}
 
 	default:
 		var err error
-		thumbnailBuf, ct, err = getVipsFromFile(fp, id, true, false)
+		if cfg.fast {
+			thumbnailBuf, ct, err = getEmbeddedThumbnail(fp, fi, o)
+			if err == nil {
+				break
+			} // too small or none, regular decode
+		}
+		if fileFormats[normExt(fp)] == "raw" && cfg.raw == "preview" {
+			thumbnailBuf, ct, err = getRawPreviewImage(fp, fi, true, o)
+			if err == nil {
+				break
+			} // no preview, full decode
+		}
+		thumbnailBuf, ct, err = getVipsFromFile(fp, fi, true, false, o)
 		if err != nil {
 			return nil, ct, err
 		}
@@ -731,8 +859,7 @@ func openWithDefaultApp(path string) error {
 }
 
 func contextHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	if !checkPost(w, r) {
 		return
 	}
 
@@ -743,7 +870,12 @@ func contextHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = openWithDefaultApp(fileInfos[data.Id].Path)
+	fi, ok := indexedFile(data.Id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	err = openWithDefaultApp(fi.Path)
 	if err != nil {
 		http.Error(w, "Error opening file: "+err.Error(), http.StatusBadRequest)
 		return
@@ -754,22 +886,16 @@ func contextHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status": "success"}`))
 }
 
-func imageHandler(w http.ResponseWriter, r *http.Request) {
-	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/image/"))
-	fp := fileInfos[id].Path
+// decodes the image served by imageHandler
+// a nil buffer without error means the file is to be served as is
+func loadImage(fi *FileInfo, o DecodeOpts) ([]byte, string, error) {
+	fp := fi.Path
 
-	// the default mode is trusting the file extension and serving the image as is
-	// if the browser detects a load error then a single retry is attempted
-	// ex. heic file.png won't be working per default
 	var imgBuf []byte
+	var ct string
 	var err error
-	var retry bool
 	var jump bool
 
-	if r.URL.Query().Get("retry") != "" {
-		retry = true
-	}
-
 _init:
 	// fitz retry, such as no image (textual only) in epub, via case redirect
 	ext := ".__fz__"
@@ -784,6 +910,9 @@ _init:
 			jump = true
 			goto _init
 		}
+		if o.Rotate != 0 {
+			imgBuf, ct, err = getVipsFromBuffer(imgBuf, false, o)
+		}
 
 	case ".mobi", ".azw3", ".azw", ".azw4", ".pdb", ".prc":
 		imgBuf, err = getMobiCoverImage(fp)
@@ -791,32 +920,34 @@ _init:
 			jump = true
 			goto _init
 		}
+		if o.Rotate != 0 {
+			imgBuf, ct, err = getVipsFromBuffer(imgBuf, false, o)
+		}
 
 	case ".pdf":
+		defer observeDecode("vips", "pdf", time.Now())
 		var vi *vips.Image
 
 		opts := vips.DefaultPdfloadOptions()
-		opts.Page = fileInfos[id].cPage
+		opts.Page = fi.cPage
 		opts.Dpi = 144
 
 		vi, err := vips.NewPdfload(fp, opts)
 		if err != nil {
-			http.Error(w, "Unable to open document: "+err.Error(), http.StatusInternalServerError)
-			return
+			return nil, "", fmt.Errorf("Unable to open document: %w", err)
 		}
 		defer vi.Close()
 
-		imgBuf, err = vi.JpegsaveBuffer(vipsJpegO)
+		imgBuf, ct, err = encode(vi, o)
 		if err != nil {
-			http.Error(w, "Unable to extract image: "+err.Error(), http.StatusInternalServerError)
-			return
+			return nil, "", fmt.Errorf("Unable to extract image: %w", err)
 		}
 
 	case ".__fz__":
+		defer observeDecode("fitz", normExt(fp), time.Now())
 		doc, err := fitz.New(fp)
 		if err != nil {
-			http.Error(w, "Unable to open document: "+err.Error(), http.StatusInternalServerError)
-			return
+			return nil, "", fmt.Errorf("Unable to open document: %w", err)
 		}
 
 		defer func() {
@@ -826,11 +957,10 @@ _init:
 		}()
 
 		mu.Lock()
-		img, err := doc.Image(fileInfos[id].cPage)
+		img, err := doc.Image(fi.cPage)
 		mu.Unlock()
 		if err != nil {
-			http.Error(w, "Unable to extract image: "+err.Error(), http.StatusInternalServerError)
-			return
+			return nil, "", fmt.Errorf("Unable to extract image: %w", err)
 		}
 
 		bounds := img.Bounds()
@@ -840,31 +970,107 @@ _init:
 		vi, _ := vips.NewImageFromMemory(rgba.Pix, bounds.Dx(), bounds.Dy(), 4)
 		defer vi.Close()
 
-		imgBuf, err = vi.JpegsaveBuffer(vipsJpegO)
+		// opaque; drop the alpha band
+		if err := vi.Flatten(nil); err != nil {
+			return nil, "", fmt.Errorf("Unable to extract image: %w", err)
+		}
+
+		imgBuf, ct, err = encode(vi, o)
 		if err != nil {
-			http.Error(w, "Unable to extract image: "+err.Error(), http.StatusInternalServerError)
-			return
+			return nil, "", fmt.Errorf("Unable to extract image: %w", err)
 		}
 
 	default: // image
-		if cfg.resize.enabled || retry {
-			if fileInfos[id].mpx > resizeMinMpx {
-				imgBuf, _, err = getVipsFromFile(fp, id, false, true)
-			} else if retry {
-				imgBuf, _, err = getVipsFromFile(fp, id, false, false)
-			} else {
-				goto _switch
+		if fileFormats[normExt(fp)] == "raw" {
+			if cfg.raw == "preview" && !o.Full {
+				imgBuf, ct, err = getRawPreviewImage(fp, fi, false, o)
+				if err == nil {
+					break
+				}
 			}
-			if err != nil {
-				http.Error(w, "Unable to serve image: "+err.Error(), http.StatusInternalServerError)
+			o.Retry = true // full decode
+		} else if normExt(fp) != "svg" {
+			if fi.transcode == 0 { // no thumbnail yet; size for the resize, orientation and cmyk
+				peekImage(fi)
+			}
+			o.Retry = o.Retry || fi.transcode > 0
+		}
+		if o.Fit.Width > 0 && fi.mpx > o.Fit.Mpx {
+			imgBuf, ct, err = getVipsFromFile(fp, fi, false, true, o)
+		} else if o.Retry {
+			imgBuf, ct, err = getVipsFromFile(fp, fi, false, false, o)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to serve image: %w", err)
+		}
+	}
+
+	return imgBuf, ct, nil
+}
+
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/image/"))
+	fi, ok := indexedFile(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fp := fi.Path
+
+	// the default mode is trusting the file extension and serving the image as is
+	// if the browser detects a load error then a single retry is attempted
+	// ex. heic file.png won't be working per default
+	var imgBuf []byte
+	var ct string
+
+	o := DecodeOpts{Format: negotiateFormat(r.Header.Get("Accept"))}
+	if r.URL.Query().Get("retry") != "" {
+		o.Retry = true
+	}
+	if r.URL.Query().Get("full") != "" { // raw: full decode instead of the embedded preview
+		o.Full, o.Retry = true, true
+	}
+
+	_, preset := clientPreset(r)
+	o.Fit = lightboxFit(preset, r.URL.Query())
+	if preset.format != "" {
+		o.Format = preset.format
+	}
+	o.Quality = preset.quality
+	if rotations != nil {
+		o.Rotate = rotations.get(fp)
+	}
+	if o.Rotate != 0 {
+		o.Retry = true
+		if o.Rotate % 180 != 0 { // bounds apply before rotation
+			o.Fit.Width, o.Fit.Height = o.Fit.Height, o.Fit.Width
+		}
+	}
+
+	// files served as is skip the scheduler; images the thumbnail found to need
+	// normalising (orientation, cmyk) or not peeked yet are left to the decoder
+	ext := normExt(fp)
+	peek := fileFormats[ext] == "img" && ext != "svg" && fi.transcode >= 0
+	if fileFormats[ext] == "doc" || fileFormats[ext] == "raw" || o.Retry || peek || (o.Fit.Width > 0 && fi.mpx > o.Fit.Mpx) {
+		var err error
+		imgBuf, ct, err = imageFlight.do(r.Context(), imageKey(id, o), func(ctx context.Context) ([]byte, string, error) {
+			return decode(ctx, id, "image", o)
+		})
+		if err != nil {
+			if r.Context().Err() != nil {
+				return // client is gone
+			}
+			if errors.Is(err, errQuarantined) {
+				servePlaceholder(w)
 				return
 			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 
-_switch:
 	// content type is determined by the browser, but we set it anyway
-	switch ext {
+	switch strings.ToLower(filepath.Ext(fp)) {
 	case ".png":
 		w.Header().Set("Content-Type", "image/png")
 	case ".gif":
@@ -884,6 +1090,10 @@ _switch:
 	}
 
 	if imgBuf != nil {
+		if ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Header().Set("Vary", "Accept, Cookie, Save-Data, Sec-CH-Viewport-Width, Sec-CH-DPR")
 		w.Write(imgBuf)
 	} else {
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -893,32 +1103,108 @@ _switch:
 	}
 }
 
+// coalescing key of an image decode
+func imageKey(id int, o DecodeOpts) string {
+	return fmt.Sprintf("%d:%v:%d:%d:%t:%t:%s", id, o.Fit, o.Quality, o.Rotate, o.Retry, o.Full, o.Format)
+}
+
+// requested thumbnail width (?w= or ?dpr=) clamped to the configured sizes, keeping it cacheable
+func thumbWidth(q url.Values) int {
+	want := int(cfg.width)
+	if v, err := strconv.Atoi(q.Get("w")); err == nil && v > 0 {
+		want = v
+	} else if v, err := strconv.ParseFloat(q.Get("dpr"), 64); err == nil && v > 0 {
+		want = int(math.Ceil(float64(cfg.width) * v))
+	}
+
+	for _, size := range cfg.sizes {
+		if size >= want {
+			return size
+		}
+	}
+	return cfg.sizes[len(cfg.sizes)-1]
+}
+
 func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/thumbnail/"))
+	fi, ok := indexedFile(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
-	buf, ct, err := generateThumbnail(id)
+	o := DecodeOpts{Format: negotiateFormat(r.Header.Get("Accept")), Width: thumbWidth(r.URL.Query())}
+	if rotations != nil {
+		o.Rotate = rotations.get(fi.Path)
+	}
+
+	key := fmt.Sprintf("%d:%d:%d:%s", id, o.Width, o.Rotate, o.Format)
+	buf, ct, err := thumbFlight.do(r.Context(), key, func(ctx context.Context) ([]byte, string, error) {
+		return decode(ctx, id, "thumbnail", o)
+	})
 	if err != nil {
+		if r.Context().Err() != nil {
+			return // client is gone
+		}
+		if errors.Is(err, errQuarantined) {
+			servePlaceholder(w)
+			return
+		}
 		http.Error(w, "Unable to generate thumbnail: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Vary", "Accept")
 	w.Write(buf)
 }
 
-func spin(d <-chan struct{}) {
+// parses the -sizes list, sorted ascending
+func parseSizes(s string) ([]int, error) {
+	if s == "" {
+		return []int{int(cfg.width), int(cfg.width) * 2}, nil
+	}
+
+	var sizes []int
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid size: %s", v)
+		}
+		sizes = append(sizes, n)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// served in place of files on the quarantine list
+func servePlaceholder(w http.ResponseWriter) {
+	buf, _ := staticFS.ReadFile("static/placeholder.svg")
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(buf)
+}
+
+// spins until d is closed; false if stop is closed first (shutting down)
+func spin(d <-chan struct{}, stop <-chan struct{}) bool {
 	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
 
 	// cursor tuning
 	fmt.Print("\033[?25l")
 	defer func() {
-		fmt.Print("\033[?25h")
 		s.Stop()
+		fmt.Print("\033[?25h")
 	}()
 
 	s.Suffix = " Indexing"
 	s.Start()
-	<-d
+	for {
+		select {
+		case <-d:
+			return true
+		case <-stop:
+			return false
+		}
+	}
 }
 
 func main() {
@@ -927,22 +1213,64 @@ func main() {
 		os.Exit(1)
 	}
 
+	flag.BoolVar(&cfg.accessLog, "access-log", false, "log every request (level info)")
+	flag.StringVar(&cfg.alpha, "alpha", "keep", "transparency: keep, flatten (onto -bg), checker")
+	bgstr := flag.String("bg", "#ffffff", "background colour for -alpha flatten")
+	flag.StringVar(&cfg.cache, "cache", "", "cache directory (default: user cache dir)")
 	flag.BoolVar(&cfg.cd, "cd", false, "current directory only (no recursion)")
+	flag.StringVar(&cfg.crop, "crop", "attention", "crop strategy for -thumb-mode smart: attention, entropy")
+	flag.BoolVar(&cfg.fifo, "fifo", false, "decode queued requests in arrival order (default newest first)")
 	flag.BoolVar(&cfg.fit, "fit", true, "fit within viewport (vertical crop)")
 	flag.BoolVar(&cfg.flat, "f", false, "flatten directory tree")
+	flag.BoolVar(&cfg.fast, "fast", false, "fast grid: thumbnails from embedded exif (jpeg) and heif thumbnails if large enough")
+	fstr := flag.String("format", "jpeg", "output formats by preference, negotiated via Accept: jpeg, webp, avif, jxl")
+	qstr := flag.String("quality", "", "per-format quality, ex. jpeg=85,webp=80,avif=50,jxl=75")
+	estr := flag.String("effort", "", "per-format encoding effort, ex. webp=4,avif=4,jxl=7")
+	flag.StringVar(&cfg.icc, "icc", "keep", "colour profile in re-encoded images: keep (srgb), strip")
 	flag.StringVar(&cfg.ip, "i", "localhost", "bind ip; empty string \"\" for all")
+	flag.UintVar(&cfg.jobs, "j", uint(runtime.NumCPU()), "max concurrent decodes")
 	flag.BoolVar(&cfg.lsd, "lsd", true, "list all directories (including empty)")
+	lfile := flag.String("log-file", "", "log to file instead of stderr")
+	lformat := flag.String("log-format", "text", "log format: text, json")
+	llevel := flag.String("log-level", "info", "log level: debug, info, warn, error")
+	flag.BoolVar(&cfg.xmp, "xmp", false, "ratings, colour labels and tags: read at index time, edited via keyboard, written to .xmp sidecars")
+	flag.BoolVar(&cfg.manage, "manage", false, "file management: trash, move, copy, rename (multi-select)")
+	flag.UintVar(&cfg.maxFails, "max-fails", 3, "quarantine files after n failed decodes")
+	flag.BoolVar(&cfg.metrics, "metrics", false, "prometheus metrics at /metrics")
 	flag.BoolVar(&cfg.open, "o", false, "open webbrowser")
+	flag.BoolVar(&cfg.slideshow, "slideshow", false, "open the webbrowser (-o implied) into the slideshow, ex. kiosk mode")
+	flag.DurationVar(&cfg.interval, "interval", 8*time.Second, "slideshow interval")
 	flag.UintVar(&cfg.port, "p", 8989, "bind port")
-	flag.StringVar(&cfg.pstr, "preset", "none", "resize preset: none, hd, 4k")
+	flag.UintVar(&cfg.pageSize, "page-size", 500, "files per page with -f")
+	flag.BoolVar(&cfg.pprof, "pprof", false, "profiling at /debug/pprof/")
+	flag.StringVar(&cfg.pstr, "preset", "none", "resize preset: none, hd, 4k or user-defined (-presets)")
+	pfile := flag.String("presets", "", "json file with user-defined resize presets")
+	flag.StringVar(&cfg.raw, "raw", "preview", "raw images: preview (embedded jpeg, full decode if none), full")
+	flag.StringVar(&cfg.rotate, "rotate", "", "persist lightbox rotation: sidecar, exif (jpeg orientation tag, sidecar otherwise); off per default")
 	flag.BoolVar(&cfg.sa, "sa", false, "sort files by mod time asc")
 	flag.BoolVar(&cfg.sd, "sd", false, "sort files by mod time desc")
 	flag.BoolVar(&cfg.sh, "sh", false, "shuffle files")
+	flag.BoolVar(&cfg.single, "single", false, "all files on a single page (default: a page per directory, -page-size files per page with -f)")
+	flag.UintVar(&cfg.th, "th", 0, "tile height in css pixels for -thumb-mode box (default: -w)")
+	flag.StringVar(&cfg.thumbMode, "thumb-mode", "width", "thumbnail mode: width, box, square, smart")
+	flag.DurationVar(&cfg.timeout, "timeout", time.Minute, "per-decode timeout, enforced by killing the worker process (0: none, allows in-process decoding)")
+	flag.DurationVar(&cfg.drain, "drain", 10*time.Second, "on shutdown, time given to in-flight requests and decodes")
 	flag.BoolVar(&cfg.version, "v", false, "print version")
 	flag.BoolVar(&cfg.verbose, "vv", false, "debug print version")
-	flag.UintVar(&cfg.width, "w", 250, "thumbnail width in pixels")
+	flag.BoolVar(&cfg.viewport, "viewport", false, "lightbox images fitted to the client viewport")
+	flag.UintVar(&cfg.width, "w", 250, "tile width in css pixels")
+	sstr := flag.String("sizes", "", "thumbnail widths in pixels served per ?w= and ?dpr= (default: 1x and 2x -w)")
+	flag.BoolVar(&cfg.worker, "worker", false, "internal: run as decode worker")
+	flag.UintVar(&cfg.workers, "workers", 0, "decode in n worker processes (0: in-process with -timeout 0, -j otherwise)")
 	flag.Parse()
 
+	if *pfile != "" {
+		if err := loadPresets(*pfile); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+
 	p, ok := Presets[strings.ToLower(cfg.pstr)]
 	if !ok {
 		fmt.Printf("unknown preset: %s\n", cfg.pstr)
@@ -951,6 +1279,57 @@ func main() {
 	}
 	cfg.resize = p
 
+	var err error
+	cfg.formats, err = parseFormats(*fstr)
+	if err == nil {
+		err = parseFormatInts(*qstr, func(e *Encoder, n int) { e.quality = n })
+	}
+	if err == nil {
+		err = parseFormatInts(*estr, func(e *Encoder, n int) { e.effort = n })
+	}
+	if err == nil {
+		cfg.bg, err = parseColour(*bgstr)
+	}
+	if err == nil && cfg.alpha != "keep" && cfg.alpha != "flatten" && cfg.alpha != "checker" {
+		err = fmt.Errorf("unknown alpha mode: %s", cfg.alpha)
+	}
+	if err == nil {
+		cfg.sizes, err = parseSizes(*sstr)
+	}
+	if err == nil {
+		switch cfg.thumbMode {
+		case "width", "box", "square", "smart":
+		default:
+			err = fmt.Errorf("unknown thumbnail mode: %s", cfg.thumbMode)
+		}
+	}
+	if err == nil && cfg.raw != "preview" && cfg.raw != "full" {
+		err = fmt.Errorf("unknown raw mode: %s", cfg.raw)
+	}
+	if err == nil && cfg.icc != "keep" && cfg.icc != "strip" {
+		err = fmt.Errorf("unknown icc mode: %s", cfg.icc)
+	}
+	if err == nil && cfg.rotate != "" && cfg.rotate != "sidecar" && cfg.rotate != "exif" {
+		err = fmt.Errorf("unknown rotate mode: %s", cfg.rotate)
+	}
+	if cfg.th == 0 { cfg.th = cfg.width }
+	if cfg.pageSize == 0 { cfg.pageSize = 500 }
+	if cfg.slideshow { cfg.open = true }
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	lf, err := setupLogging(*llevel, *lformat, *lfile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if lf != nil { defer lf.Close() }
+
+	sched = newScheduler(int(cfg.jobs), !cfg.fifo)
+
 	// vips init
 	vips.Startup(&vips.Config{})
 	defer vips.Shutdown()
@@ -966,6 +1345,29 @@ func main() {
 		fmt.Printf("FzVersion: %v\n", fitz.FzVersion)
 		os.Exit(0)
 	}
+	if cfg.worker {
+		runWorker()
+		return
+	}
+	// in-process decodes can't be interrupted; the timeout kills a worker instead
+	if cfg.timeout > 0 && cfg.workers == 0 {
+		cfg.workers = cfg.jobs
+	}
+	if cfg.workers > 0 {
+		pool = newWorkerPool(int(cfg.workers), os.Args[1:])
+	}
+
+	if cfg.cache == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		cfg.cache = filepath.Join(dir, "thumbnailer")
+	}
+	quarantine = loadQuarantine(filepath.Join(cfg.cache, "quarantine.json"))
+	if cfg.rotate != "" {
+		rotations = loadRotations(filepath.Join(cfg.cache, "rotations.json"))
+	}
 
 	if cfg.ip == "" { cfg.ip = "0.0.0.0" }
 	addr := fmt.Sprintf("%s:%d", cfg.ip, cfg.port)
@@ -978,115 +1380,138 @@ func main() {
 
 	if cfg.flat { cfg.lsd = false }
 
+	root, err := filepath.Abs(os.Args[len(os.Args)-1])
+	if err == nil {
+		if inf, serr := os.Stat(root); serr != nil || !inf.IsDir() {
+			err = errors.New("invalid path (not a directory)")
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cfg.root = root
+	albums = loadAlbums(cfg.cache, cfg.root)
+	dirMenu = cfg.lsd
+
+	// explicit mux; net/http/pprof registers on the default one
+	mux := http.NewServeMux()
+	if cfg.metrics {
+		mux.HandleFunc("/metrics", metricsHandler)
+	}
+	if cfg.pprof { // expose the command line and memory stats
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	mux.HandleFunc("/static/", instrument("static", http.FileServer(http.FS(staticFS)).ServeHTTP))
+
+	mux.HandleFunc("/thumbnail/", instrument("thumbnail", thumbnailHandler))
+	mux.HandleFunc("/image/", instrument("image", imageHandler))
+	mux.HandleFunc("/context/", instrument("context", contextHandler))
+	mux.HandleFunc("/failures", instrument("failures", failuresHandler))
+	mux.HandleFunc("/albums", instrument("albums", albumsHandler))
+	mux.HandleFunc("/album/", instrument("album", albumHandler))
+	mux.HandleFunc("/slideshow", instrument("slideshow", slideshowHandler))
+	mux.HandleFunc("/download", instrument("download", downloadHandler))
+	mux.HandleFunc("/progress", instrument("progress", progressHandler))
+	if rotations != nil {
+		mux.HandleFunc("/rotate/", instrument("rotate", rotateHandler))
+	}
+	if cfg.manage {
+		mux.HandleFunc("/manage/", instrument("manage", manageHandler))
+	}
+	if cfg.xmp {
+		mux.HandleFunc("/meta/", instrument("meta", metaHandler))
+	}
+
+	mux.HandleFunc("/d/", instrument("dir", dirPageHandler))
+	mux.HandleFunc("/dirs", instrument("dirs", dirTreeHandler))
+	mux.HandleFunc("/", instrument("index", indexHandler))
+
+	// serve while indexing; pages poll /progress for directories indexed since
+	srv := &http.Server{Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	fmt.Printf("Server running on http://%s\nCtrl+c to exit\n", addr)
+	if cfg.open && !cfg.slideshow { // the grid fills in while indexing
+		go func() {
+			time.Sleep(250 * time.Millisecond)
+			open(fmt.Sprintf("http://%s", addr))
+		}()
+	}
+
+	// ctrl+c shuts down gracefully, also while indexing; the spinner restores the cursor
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				go reindex()
+				continue
+			}
+			close(stop)
+			shutdown(srv, sig)
+			return
+		}
+	}()
+
 	// spin while indexing
 	   d := make(chan struct{})
 	 res := make(chan uint)
 	errc := make(chan error, 1)
 	var dcnt uint
+	start := time.Now()
 
+	indexing.Store(true)
 	go func() {
-		p, err := filepath.Abs(os.Args[len(os.Args)-1])
+		infos, dcnt, err := walkDir(cfg.root, d, publishIndex)
 		if err != nil {
 			errc <- err
 			return
 		}
-		dcnt, err := walkDir(p, d)
-		if err != nil {
-			errc <- err
-			return
+		indexMu.Lock()
+		if cfg.flat { // published per directory otherwise, keeping ratings and labels set meanwhile
+			fileInfos = infos
 		}
+		indexLen = len(fileInfos)
+		dirMenu = cfg.lsd && dcnt > 1
+		indexMu.Unlock()
 		res <- dcnt
 	}()
 
-	spin(d)
+	if !spin(d, stop) {
+		fmt.Println()
+		<-done // decodes are drained before libvips is shut down
+		return
+	}
 	select {
 		case dcnt = <-res:
 		case err := <-errc:
 			fmt.Println(err)
 			os.Exit(1)
 	}
+	slog.Info("indexed", "root", cfg.root, "dirs", dcnt, "entries", indexLen, "took", time.Since(start).Round(time.Millisecond))
+	indexing.Store(false) // reindexing (SIGHUP) and managing are accepted from here on
 
-	cssHidden := ""
-	if !cfg.lsd || dcnt < 2 { cssHidden = " hidden" }
-
-	http.Handle("/static/", http.FileServer(http.FS(staticFS)))
-
-	http.HandleFunc("/thumbnail/", thumbnailHandler)
-	http.HandleFunc("/image/", imageHandler)
-	http.HandleFunc("/context/", contextHandler)
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, `<!doctype html>
-<html>
-<head>
-<meta charset="utf-8" />
-<meta name="viewport" content="width=device-width, initial-scale=1.0">
-<title>thumbnailer</title>
-<link rel="icon" type="image/x-icon" href="/static/favicon.ico">
-<link rel="stylesheet" href="/static/style.css">
-<script src="/static/script.js" defer></script>
-<style>:root { --tile-w: %dpx; }</style>
-`, cfg.width)
-
-		fmt.Fprintf(w, `
-</head>
-<body data-width="%d" data-fit="%t">
-<div class="menu%s" id="menu">&#9776;</div>
-<ul class="menu-list" id="menuList"></ul>
-<div class="menu-overlay" id="menuOverlay"></div>
-<div id="lightbox">
-	<div id="lightboxClose">&#x2716;</div>
-	<img id="lightboxImage" src="" />
-</div>
-<div id="btn-top"><a href="#" class="btn-top"></a></div>
-<div id="btn-mode"><a href="javascript:void(0)"></a></div>
-`, cfg.width, cfg.fit, cssHidden)
-
-		first := true
-		var last bool
-
-		for _, itm := range fileInfos {
-			if itm.isFile {
-				if first {
-					fmt.Fprint(w, `<ul class="flex">`)
-					first = false
-				} else if last != itm.isFile {
-					fmt.Fprint(w, `</ul><ul class="flex">`)
-				}
-				last = itm.isFile
-
-				if cfg.lsd {
-					fmt.Fprintf(w, `<li><img title="%s" data-id="%d" data-ct="%s" /><span class="name">%s</span></li>`, itm.Name, itm.ID, itm.cType, itm.Name)
-				} else {
-					fmt.Fprintf(w, `<li><img title="%s" data-id="%d" data-ct="%s" /><span class="name">%s</span></li>`, itm.Path, itm.ID, itm.cType, itm.Name)
-				}
-			} else if cfg.lsd {
-				if first {
-					fmt.Fprint(w, `<ul class="stretch">`)
-					first = false
-				} else if last != itm.isFile {
-					fmt.Fprint(w, `</ul><ul class="stretch">`)
-				}
-				last = itm.isFile
-
-				fmt.Fprintf(w, `<li><div class="dir-container" id="%d"><span>%s</span></div></li>`, itm.ID, itm.Path)
-			}
-		}
-		fmt.Fprint(w, `</ul></body></html>`)
-	})
-
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		if cfg.open {
-			time.Sleep(250 * time.Millisecond)
-			open(fmt.Sprintf("http://%s", addr))
-		}
-		<-c
-		os.Exit(0)
-	}()
+	if cfg.open && cfg.slideshow { // the slideshow takes the index as of loading
+		open(fmt.Sprintf("http://%s/slideshow", addr))
+	}
 
-	fmt.Printf("Server running on http://%s\nCtrl+c to exit\n", addr)
-	http.Serve(ln, nil)
+	if err := <-serveErr; err != http.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		return
+	}
+	<-done
 }
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// file management (-manage): trash, move or copy to an indexed directory, rename
+// the index is updated in place; removed entries keep their id, additions are appended
+
+var (
+	indexMu  sync.RWMutex // guards index mutations
+	indexLen int          // entries of the initial walk
+)
+
+type manageRequest struct {
+	IDs  []int  `json:"ids"`
+	Dir  int    `json:"dir"`  // move, copy: id of the target directory
+	Name string `json:"name"` // rename
+}
+
+type manageResult struct {
+	ID    int    `json:"id"`
+	NewID int    `json:"newId,omitempty"` // move, copy
+	Error string `json:"error,omitempty"`
+}
+
+// guards state-changing requests against cross-site posts
+// json only: a form or text/plain post of another site can't set it without a (unanswered) preflight;
+// the browser's Sec-Fetch-Site and Origin must match this server
+func checkPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return false
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		http.Error(w, "Cross-site request", http.StatusForbidden)
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			http.Error(w, "Cross-origin request", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// POST /manage/{trash,move,copy,rename}
+func manageHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+
+	// ids of runtime additions follow the index
+	if indexing.Load() {
+		http.Error(w, "Indexing in progress", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req manageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	op := strings.TrimPrefix(r.URL.Path, "/manage/")
+	switch op {
+	case "trash", "move", "copy":
+	case "rename":
+		if len(req.IDs) != 1 {
+			http.Error(w, "Rename requires a single file", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	results := make([]manageResult, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		res := manageResult{ID: id}
+		var err error
+
+		switch op {
+		case "trash":
+			err = trashFile(id)
+		case "move":
+			res.NewID, err = moveFile(id, req.Dir, false)
+		case "copy":
+			res.NewID, err = moveFile(id, req.Dir, true)
+		case "rename":
+			err = renameFile(id, req.Name)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// file entry of the index, nil if unknown or removed; the caller holds indexMu for writing
+func fileEntry(id int) *FileInfo {
+	if id < 0 || id >= len(fileInfos) || !fileInfos[id].isFile || fileInfos[id].removed {
+		return nil
+	}
+	return &fileInfos[id]
+}
+
+// copy of a file entry, false if unknown or removed
+func indexedFile(id int) (FileInfo, bool) {
+	indexMu.RLock()
+	defer indexMu.RUnlock()
+
+	if fi := fileEntry(id); fi != nil {
+		return *fi, true
+	}
+	return FileInfo{}, false
+}
+
+// copy of a directory entry, false if unknown
+func indexedDir(id int) (FileInfo, bool) {
+	indexMu.RLock()
+	defer indexMu.RUnlock()
+
+	if id < 0 || id >= len(fileInfos) || fileInfos[id].isFile {
+		return FileInfo{}, false
+	}
+	return fileInfos[id], true
+}
+
+// reports whether p resolves within the indexed root
+func insideRoot(p string) bool {
+	root, err := filepath.EvalSymlinks(cfg.root)
+	if err != nil {
+		return false
+	}
+	if rp, err := filepath.EvalSymlinks(p); err == nil {
+		p = rp
+	} else {
+		return false
+	}
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func trashFile(id int) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	fi := fileEntry(id)
+	if fi == nil {
+		return errors.New("unknown file")
+	}
+	if !insideRoot(fi.Path) {
+		return errors.New("outside of the indexed root")
+	}
+	if err := trash(fi.Path); err != nil {
+		return err
+	}
+	fi.removed = true
+	if sc := ownSidecar(fi.Path); sc != "" {
+		trash(sc)
+	}
+	return nil
+}
+
+// moves or copies to the directory entry dir, without overwriting; returns the id of the new entry
+func moveFile(id, dir int, copy bool) (int, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	fi := fileEntry(id)
+	if fi == nil {
+		return 0, errors.New("unknown file")
+	}
+	if dir < 0 || dir >= len(fileInfos) || fileInfos[dir].isFile {
+		return 0, errors.New("unknown directory")
+	}
+	if !insideRoot(fi.Path) || !insideRoot(fileInfos[dir].Path) {
+		return 0, errors.New("outside of the indexed root")
+	}
+
+	dst := filepath.Join(fileInfos[dir].Path, fi.Name)
+	if dst == fi.Path {
+		return 0, errors.New("same directory")
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return 0, fmt.Errorf("%s exists", dst)
+	}
+
+	var err error
+	if copy {
+		err = copyFile(fi.Path, dst)
+	} else if err = os.Rename(fi.Path, dst); errors.Is(err, syscall.EXDEV) { // other filesystem
+		if err = copyFile(fi.Path, dst); err == nil {
+			err = os.Remove(fi.Path)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := moveSidecar(fi.Path, dst, copy); err != nil {
+		slog.Warn("sidecar not moved", "path", fi.Path, "err", err)
+	}
+
+	entry := *fi
+	entry.ID, entry.Path, entry.dir = len(fileInfos), dst, dir
+	if !copy {
+		fi.removed = true
+		if rotations != nil {
+			rotations.rename(fi.Path, dst)
+		}
+		albums.rename(fi.Path, dst)
+	}
+	fileInfos = append(fileInfos, entry)
+	return entry.ID, nil
+}
+
+// renames within the directory; the extension must remain a supported one
+func renameFile(id int, name string) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	fi := fileEntry(id)
+	if fi == nil {
+		return errors.New("unknown file")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return errors.New("invalid name")
+	}
+	cType, ok := fileFormats[normExt(name)]
+	if !ok {
+		return errors.New("unsupported extension")
+	}
+	if !insideRoot(fi.Path) {
+		return errors.New("outside of the indexed root")
+	}
+
+	dst := filepath.Join(filepath.Dir(fi.Path), name)
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s exists", name)
+	}
+	if err := os.Rename(fi.Path, dst); err != nil {
+		return err
+	}
+	if err := moveSidecar(fi.Path, dst, false); err != nil {
+		slog.Warn("sidecar not renamed", "path", fi.Path, "err", err)
+	}
+
+	if rotations != nil {
+		rotations.rename(fi.Path, dst)
+	}
+	albums.rename(fi.Path, dst)
+	fi.Path, fi.Name, fi.cType = dst, name, cType
+	return nil
+}
+
+// copies via a temporary file, keeping mode and modification time
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = io.Copy(f, in)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, st.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, st.ModTime(), st.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// moves fp to the freedesktop.org home trash
+// https://specifications.freedesktop.org/trash-spec/latest/
+func trash(fp string) error {
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd":
+	default:
+		return fmt.Errorf("trash is not supported on %s", runtime.GOOS)
+	}
+
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		data = filepath.Join(home, ".local", "share")
+	}
+	dir := filepath.Join(data, "Trash")
+	for _, sub := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	base := filepath.Base(fp)
+	ext := filepath.Ext(base)
+	for i := 1; i < 1000; i++ {
+		name := base
+		if i > 1 { name = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(base, ext), i, ext) }
+
+		// the info file reserves the name
+		info := filepath.Join(dir, "info", name+".trashinfo")
+		f, err := os.OpenFile(info, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(f, "[Trash Info]\nPath=%s\nDeletionDate=%s\n", (&url.URL{Path: fp}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(fp, filepath.Join(dir, "files", name))
+		}
+		if err != nil {
+			os.Remove(info)
+			if errors.Is(err, syscall.EXDEV) {
+				return errors.New("trash is on another filesystem")
+			}
+		}
+		return err
+	}
+	return errors.New("trash: no free name")
+}
+
+// index in display order, without removed entries
+// entries added at runtime follow the files of their directory, or the end in flat mode
+func displayOrder() []FileInfo {
+	indexMu.RLock()
+	defer indexMu.RUnlock()
+
+	added := make(map[int][]FileInfo)
+	for _, itm := range fileInfos[indexLen:] {
+		if !itm.removed {
+			added[itm.dir] = append(added[itm.dir], itm)
+		}
+	}
+
+	list := make([]FileInfo, 0, len(fileInfos))
+	dir := -1
+	flush := func() {
+		list = append(list, added[dir]...)
+		delete(added, dir)
+	}
+	for _, itm := range fileInfos[:indexLen] {
+		if !itm.isFile && !cfg.flat {
+			flush()
+			dir = itm.ID
+		}
+		if !itm.removed {
+			list = append(list, itm)
+		}
+	}
+	flush()
+
+	for _, itm := range fileInfos[indexLen:] {
+		if _, ok := added[itm.dir]; ok && !itm.removed {
+			list = append(list, itm)
+		}
+	}
+	return list
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"thumbnailer/vips"
+)
+
+// prometheus text exposition (-metrics), without client library
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+	httpRequests = newCounterVec("thumbnailer_http_requests_total", "HTTP requests per handler and status code.", "handler", "code")
+	httpDuration = newHistogramVec("thumbnailer_http_request_duration_seconds", "HTTP request latency per handler.", latencyBuckets, "handler")
+	decodes      = newCounterVec("thumbnailer_decodes_total", "Decodes per operation and result.", "op", "result")
+	decodeTime   = newHistogramVec("thumbnailer_decode_duration_seconds", "Decode duration per format and decoder.", latencyBuckets, "format", "decoder")
+)
+
+// timings taken in a worker process, reported back with the result
+type decodeTiming struct {
+	Decoder string
+	Format  string
+	Seconds float64
+}
+
+var (
+	workerTimings  []decodeTiming // worker mode, per job
+	workerEmbedded int            // 1 embedded thumbnail used, -1 none or too small, 0 not looked up
+)
+
+// records a decode step; deferred as observeDecode(decoder, format, time.Now())
+func observeDecode(decoder, format string, start time.Time) {
+	t := decodeTiming{decoder, format, time.Since(start).Seconds()}
+	if cfg.worker {
+		workerTimings = append(workerTimings, t)
+		return
+	}
+	decodeTime.observe(t.Seconds, t.Format, t.Decoder)
+}
+
+// counts an embedded thumbnail lookup (-fast)
+func observeEmbedded(hit bool) {
+	if cfg.worker {
+		workerEmbedded = -1
+		if hit {
+			workerEmbedded = 1
+		}
+		return
+	}
+	if hit {
+		embeddedHits.Add(1)
+	} else {
+		embeddedMisses.Add(1)
+	}
+}
+
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // key: label values joined by \xff
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(values, "\xff")]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, k, ""), formatFloat(c.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	k := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, k, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, k, ""), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// {a="x",b="y"} from label names and joined values, with le for histogram buckets
+func labelString(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], escapeLabel(v)))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// counters kept in expvar (flights, embedded thumbnails), as prometheus counters
+func writeExpvarMap(w io.Writer, name, help, label string, m *expvar.Map) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	m.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, escapeLabel(kv.Key), kv.Value.String())
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	size int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// counts and times requests per handler (-metrics), logs them (-access-log)
+func instrument(name string, h http.HandlerFunc) http.HandlerFunc {
+	if !cfg.metrics && !cfg.accessLog {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h(sw, r)
+		if cfg.metrics {
+			httpDuration.observe(time.Since(start).Seconds(), name)
+			httpRequests.inc(name, strconv.Itoa(sw.code))
+		}
+		if cfg.accessLog {
+			accessLog(r, name, sw.code, sw.size, start)
+		}
+	}
+}
+
+// there are no cache hit rates: decoded thumbnails and images aren't cached (server side),
+// images served as is are no-store, and the libvips operation cache keeps no hit counts
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	httpRequests.write(w)
+	httpDuration.write(w)
+	decodes.write(w)
+	decodeTime.write(w)
+
+	writeExpvarMap(w, "thumbnailer_decode_runs_total", "Decodes run per flight (thumbnail, image).", "flight", decodeRuns)
+	writeExpvarMap(w, "thumbnailer_decode_coalesced_total", "Requests served by a concurrent identical decode; results aren't kept, this is no cache hit.", "flight", coalesced)
+	fmt.Fprintf(w, "# HELP thumbnailer_embedded_thumbnails_total Embedded thumbnails used (-fast).\n# TYPE thumbnailer_embedded_thumbnails_total counter\n")
+	fmt.Fprintf(w, "thumbnailer_embedded_thumbnails_total{result=\"hit\"} %d\n", embeddedHits.Value())
+	fmt.Fprintf(w, "thumbnailer_embedded_thumbnails_total{result=\"miss\"} %d\n", embeddedMisses.Value())
+
+	running, queued := sched.stats()
+	writeGauge(w, "thumbnailer_decodes_in_flight", "Decodes running.", float64(running))
+	writeGauge(w, "thumbnailer_decodes_queued", "Decodes waiting for a slot.", float64(queued))
+
+	writeGauge(w, "thumbnailer_vips_memory_bytes", "libvips tracked memory (this process).", float64(vips.TrackedGetMem()))
+	writeGauge(w, "thumbnailer_vips_memory_highwater_bytes", "libvips tracked memory high-water mark.", float64(vips.TrackedGetMemHighwater()))
+	writeGauge(w, "thumbnailer_vips_allocations", "libvips tracked allocations.", float64(vips.TrackedGetAllocs()))
+	writeGauge(w, "thumbnailer_vips_open_files", "libvips open files.", float64(vips.TrackedGetFiles()))
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	writeGauge(w, "go_memstats_heap_alloc_bytes", "Go heap bytes allocated and in use.", float64(ms.HeapAlloc))
+	writeGauge(w, "go_goroutines", "Goroutines.", float64(runtime.NumGoroutine()))
+}
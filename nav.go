@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// paged grid: a page per directory at /d/{id}, / redirects to the first one
+// flat (-f): -page-size files per page at /?page={n}
+// -single: everything on one page, as indexed
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	// checked first: once indexing is done, the list is complete
+	streaming := indexing.Load()
+	list := displayOrder()
+
+	switch {
+	case cfg.single:
+		writePageHead(w, r, "thumbnailer", "")
+		if streaming {
+			writeProgress(w, len(list))
+		}
+		writeSelectbar(w)
+		writeList(w, list)
+
+	case cfg.flat:
+		var files []FileInfo
+		for _, itm := range list {
+			if itm.isFile {
+				files = append(files, itm)
+			}
+		}
+		size := int(cfg.pageSize)
+		pages := (len(files) + size - 1) / size
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		page = min(max(page, 1), max(pages, 1))
+		chunk := files[min((page-1)*size, len(files)):min(page*size, len(files))]
+
+		var prev, next string
+		if page > 1 { prev = fmt.Sprintf("/?page=%d", page-1) }
+		if page < pages { next = fmt.Sprintf("/?page=%d", page+1) }
+		label := fmt.Sprintf("page %d of %d", page, max(pages, 1))
+
+		writePageHead(w, r, "thumbnailer: "+label, "")
+		if streaming {
+			writeProgress(w, 0) // reloaded once sorted
+		}
+		writeNav(w, prev, label, next)
+		writeSelectbar(w)
+		writeList(w, chunk)
+		writeNav(w, prev, label, next)
+
+	default:
+		for _, itm := range list {
+			if !itm.isFile {
+				http.Redirect(w, r, fmt.Sprintf("/d/%d", itm.ID), http.StatusFound)
+				return
+			}
+		}
+		// nothing indexed yet; reloaded with the first directory
+		writePageHead(w, r, "thumbnailer", "")
+		if streaming {
+			writeProgress(w, 0)
+		}
+	}
+	fmt.Fprint(w, `</body></html>`)
+}
+
+// GET /d/{id}[?to=prev|next]; to redirects to the neighbouring directory at the time of the request
+func dirPageHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.flat || cfg.single {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/d/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	streaming := indexing.Load()
+	list := displayOrder()
+
+	start := -1
+	for i, itm := range list {
+		if itm.ID == id && !itm.isFile {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	end := start + 1
+	for end < len(list) && list[end].isFile {
+		end++
+	}
+	prev := -1
+	for i := start - 1; i >= 0; i-- {
+		if !list[i].isFile {
+			prev = list[i].ID
+			break
+		}
+	}
+
+	switch r.URL.Query().Get("to") {
+	case "prev":
+		if prev >= 0 { id = prev }
+		http.Redirect(w, r, fmt.Sprintf("/d/%d", id), http.StatusFound)
+		return
+	case "next":
+		if end < len(list) { id = list[end].ID }
+		http.Redirect(w, r, fmt.Sprintf("/d/%d", id), http.StatusFound)
+		return
+	}
+
+	var prevLink, nextLink string
+	if prev >= 0 { prevLink = fmt.Sprintf("/d/%d?to=prev", id) }
+	if end < len(list) || streaming { nextLink = fmt.Sprintf("/d/%d?to=next", id) }
+	label := relPath(list[start].Path)
+	if label == "." { label = cfg.root }
+
+	writePageHead(w, r, label, "")
+	if streaming {
+		writeProgress(w, -1)
+	}
+	writeNav(w, prevLink, label, nextLink)
+	writeSelectbar(w)
+	writeList(w, list[start:end])
+	writeNav(w, prevLink, label, nextLink)
+	fmt.Fprint(w, `</body></html>`)
+}
+
+// previous / next links (keys [ and ]); empty if none
+func writeNav(w io.Writer, prev, label, next string) {
+	fmt.Fprint(w, `<div class="nav">`)
+	if prev != "" {
+		fmt.Fprintf(w, `<a href="%s" rel="prev">&laquo; previous</a>`, prev)
+	} else {
+		fmt.Fprint(w, `<span class="disabled">&laquo; previous</span>`)
+	}
+	fmt.Fprintf(w, `<span class="label">%s</span>`, html.EscapeString(label))
+	if next != "" {
+		fmt.Fprintf(w, `<a href="%s" rel="next">next &raquo;</a>`, next)
+	} else {
+		fmt.Fprint(w, `<span class="disabled">next &raquo;</span>`)
+	}
+	fmt.Fprint(w, "</div>\n")
+}
+
+type dirNode struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"` // root-relative
+	ID       int    `json:"id"`   // -1: no files of its own
+	Children bool   `json:"children"`
+}
+
+// GET /dirs?path={root-relative path}: subdirectories leading to indexed ones, for the menu tree
+// the root itself is listed first at the top level
+// GET /dirs?all=1: every indexed directory, flat (move and copy targets); name is the full path
+func dirTreeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("all") != "" {
+		nodes := []dirNode{}
+		for _, itm := range displayOrder() {
+			if !itm.isFile {
+				nodes = append(nodes, dirNode{Name: itm.Path, Path: relPath(itm.Path), ID: itm.ID})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nodes)
+		return
+	}
+
+	parent := strings.Trim(r.URL.Query().Get("path"), "/")
+	prefix := ""
+	if parent != "" { prefix = parent + "/" }
+
+	nodes := []*dirNode{}
+	byName := make(map[string]*dirNode)
+	for _, itm := range displayOrder() {
+		if itm.isFile {
+			continue
+		}
+		rel := relPath(itm.Path)
+		if rel == "." {
+			if parent == "" {
+				nodes = append(nodes, &dirNode{Name: ".", ID: itm.ID})
+			}
+			continue
+		}
+		if !strings.HasPrefix(rel, prefix) {
+			continue
+		}
+		name, _, deeper := strings.Cut(rel[len(prefix):], "/")
+		n, ok := byName[name]
+		if !ok {
+			n = &dirNode{Name: name, Path: prefix + name, ID: -1}
+			byName[name] = n
+			nodes = append(nodes, n)
+		}
+		if deeper {
+			n.Children = true
+		} else {
+			n.ID = itm.ID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// shared grid page markup (index, albums)
+
+var dirMenu bool // directory entries in the menu
+
+// head, menu and lightbox; album is the album shown, if any
+func writePageHead(w http.ResponseWriter, r *http.Request, title, album string) {
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Accept-CH", "Sec-CH-Viewport-Width, Sec-CH-DPR, Viewport-Width, DPR")
+	fmt.Fprintf(w, `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>%s</title>
+<link rel="icon" type="image/x-icon" href="/static/favicon.ico">
+<link rel="stylesheet" href="/static/style.css">
+<script src="/static/script.js" defer></script>
+<style>:root { --tile-w: %dpx; --tile-h: %dpx; }</style>
+`, html.EscapeString(title), cfg.width, cfg.th)
+
+	fmt.Fprintf(w, `
+</head>
+<body data-width="%d" data-fit="%t" data-mode="%s" data-viewport="%t" data-dirs="%t" data-tree="%t" data-rotate="%t" data-manage="%t" data-xmp="%t" data-album="%s">
+<div class="menu" id="menu">&#9776;</div>
+<ul class="menu-list" id="menuList">`, cfg.width, cfg.fit, cfg.thumbMode, cfg.viewport, dirMenu && album == "" && cfg.single, !cfg.single && !cfg.flat, rotations != nil, cfg.manage, cfg.xmp, html.EscapeString(album))
+
+	current, _ := clientPreset(r)
+	for _, name := range presetNames() {
+		active := ""
+		if name == current { active = " active" }
+		fmt.Fprintf(w, `<li class="preset%s" data-preset="%s">preset: %s</li>`, active, name, name)
+	}
+	if cfg.manage && album == "" {
+		fmt.Fprint(w, `<li class="action" data-action="select">select files (m)</li>`)
+	}
+	if cfg.xmp {
+		for i := 1; i <= 5; i++ {
+			fmt.Fprintf(w, `<li class="action" data-action="rating" data-value="%d">filter: %s+</li>`, i, strings.Repeat("&#9733;", i))
+		}
+		for _, l := range labels {
+			fmt.Fprintf(w, `<li class="action" data-action="label" data-value="%s">filter: %s</li>`, l, l)
+		}
+		fmt.Fprint(w, `<li class="action" data-action="sort">sort by rating</li>`)
+		fmt.Fprint(w, `<li class="action" data-action="clear">clear filter and sort</li>`)
+	}
+	if album != "" {
+		fmt.Fprint(w, `<li class="link"><a href="/">all files</a></li>`)
+		fmt.Fprintf(w, `<li class="link"><a href="/slideshow?album=%s">slideshow</a></li>`, url.QueryEscape(album))
+	} else {
+		fmt.Fprint(w, `<li class="link"><a href="/slideshow">slideshow</a></li>`)
+	}
+	fmt.Fprint(w, `<li class="action" data-action="download">download shown (originals)</li>`)
+	fmt.Fprint(w, `<li class="action" data-action="download-resized">download shown (resized)</li>`)
+	for _, a := range albums.list() {
+		if a.Name == album { continue }
+		fmt.Fprintf(w, `<li class="link"><a href="/album/%s">album: %s (%d)</a></li>`, url.PathEscape(a.Name), html.EscapeString(a.Name), a.Count)
+	}
+
+	fmt.Fprint(w, `</ul>
+<div class="menu-overlay" id="menuOverlay"></div>
+<div id="lightbox">
+	<div id="lightboxClose">&#x2716;</div>
+	<img id="lightboxImage" src="" />
+</div>
+<div id="btn-top"><a href="#" class="btn-top"></a></div>
+<div id="btn-mode"><a href="javascript:void(0)"></a></div>
+`)
+}
+
+// multi-select actions (-manage); move and copy targets (all indexed directories)
+// are loaded from /dirs?all=1 once selecting
+func writeSelectbar(w io.Writer) {
+	if !cfg.manage {
+		return
+	}
+	fmt.Fprint(w, `<div id="selectbar" class="hidden"><span id="selectCount">0</span> selected
+	<button data-op="trash">trash</button>
+	<select id="selectDir"></select>
+	<button data-op="move">move</button>
+	<button data-op="copy">copy</button>
+	<button data-op="rename">rename</button>
+	<button data-op="download">download</button>
+	<button data-op="download-resized">download resized</button>
+	<button data-op="done">done</button>
+</div>
+`)
+}
+
+// banner while indexing; from is the number of entries on the page, -1 for none to be appended
+func writeProgress(w io.Writer, from int) {
+	fmt.Fprintf(w, `<div id="progress" data-from="%d">Indexing: %d directories, %d files</div>
+`, from, indexDirs.Load(), indexFiles.Load())
+}
+
+// directories (-lsd) and grids of their files
+func writeList(w io.Writer, list []FileInfo) {
+	first := true
+	var last bool
+
+	for _, itm := range list {
+		if itm.isFile {
+			if first {
+				fmt.Fprint(w, `<ul class="flex">`)
+				first = false
+			} else if last != itm.isFile {
+				fmt.Fprint(w, `</ul><ul class="flex">`)
+			}
+			last = itm.isFile
+
+			writeTile(w, itm)
+		} else if cfg.lsd {
+			if first {
+				fmt.Fprint(w, `<ul class="stretch">`)
+				first = false
+			} else if last != itm.isFile {
+				fmt.Fprint(w, `</ul><ul class="stretch">`)
+			}
+			last = itm.isFile
+
+			fmt.Fprintf(w, `<li><div class="dir-container" id="%d"><span>%s</span></div></li>`, itm.ID, html.EscapeString(itm.Path))
+		}
+	}
+	if !first {
+		fmt.Fprint(w, `</ul>`)
+	}
+}
+
+// grid tile; the title is the name with -lsd, the path otherwise
+func writeTile(w io.Writer, itm FileInfo) {
+	title := itm.Path
+	if cfg.lsd { title = itm.Name }
+	fmt.Fprintf(w, `<li%s><img title="%s" data-id="%d" data-ct="%s" data-srcset="/thumbnail/%d 1x, /thumbnail/%d?dpr=2 2x" /><span class="name">%s</span></li>`, metaAttrs(itm), html.EscapeString(title), itm.ID, itm.cType, itm.ID, itm.ID, html.EscapeString(itm.Name))
+}
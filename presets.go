@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// user-defined presets (-presets), ex.
+// {"phone": {"width": 1280, "height": 1280, "mpx": 2, "quality": 70, "format": "webp"}}
+type presetConfig struct {
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`  // default: width
+	Mpx     float64 `json:"mpx"`     // resize trigger, default: resizeMinMpx
+	Quality int     `json:"quality"` // default: per format (-quality)
+	Format  string  `json:"format"`  // default: negotiated (-format)
+}
+
+func loadPresets(fp string) error {
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+
+	var pcs map[string]presetConfig
+	if err := json.Unmarshal(buf, &pcs); err != nil {
+		return fmt.Errorf("%s: %w", fp, err)
+	}
+
+	for name, pc := range pcs {
+		if pc.Width < 1 {
+			return fmt.Errorf("preset %s: width required", name)
+		}
+		p := Preset{enabled: true, width: pc.Width, height: pc.Height, mpx: pc.Mpx, quality: pc.Quality}
+		if p.height < 1 { p.height = p.width }
+		if p.mpx <= 0 { p.mpx = resizeMinMpx }
+		if pc.Format != "" {
+			f, err := parseFormats(pc.Format)
+			if err != nil || len(f) != 1 {
+				return fmt.Errorf("preset %s: invalid format: %s", name, pc.Format)
+			}
+			p.format = f[0]
+		}
+		Presets[strings.ToLower(name)] = p
+	}
+	return nil
+}
+
+// lightbox resize bounds per preset, or per client viewport (?vw=&vh=&dpr=) capped by the preset
+// viewport sizes are rounded up to steps of 256 pixels, keeping them cacheable
+func lightboxFit(p Preset, q url.Values) Fit {
+	vw, _ := strconv.Atoi(q.Get("vw"))
+	vh, _ := strconv.Atoi(q.Get("vh"))
+	if vw > 0 && vh > 0 {
+		dpr, err := strconv.ParseFloat(q.Get("dpr"), 64)
+		if err != nil || dpr <= 0 { dpr = 1 }
+
+		step := func(v int) int { return int(math.Ceil(float64(v) * dpr / 256)) * 256 }
+		w, h := step(vw), step(vh)
+		if p.enabled {
+			w, h = min(w, p.width), min(h, p.height)
+		}
+		return Fit{Width: w, Height: h, Mpx: float64(w * h) / 1000000.0}
+	}
+
+	if !p.enabled {
+		return Fit{}
+	}
+	return Fit{Width: p.width, Height: p.height, Mpx: p.mpx}
+}
+
+// preset of a request, in order: ?preset=, the preset cookie (menu), Save-Data, client hints, -preset
+// Save-Data picks the smallest preset; client hints the smallest covering the viewport in device pixels
+func clientPreset(r *http.Request) (string, Preset) {
+	name := r.URL.Query().Get("preset")
+	if name == "" {
+		if c, err := r.Cookie("preset"); err == nil {
+			name = c.Value
+		}
+	}
+	if p, ok := Presets[strings.ToLower(name)]; ok {
+		return strings.ToLower(name), p
+	}
+
+	if r.Header.Get("Save-Data") == "on" {
+		for _, name := range presetNames() {
+			if Presets[name].enabled {
+				return name, Presets[name]
+			}
+		}
+	}
+
+	vw, _ := strconv.Atoi(headerHint(r, "Sec-CH-Viewport-Width", "Viewport-Width"))
+	if vw > 0 {
+		dpr, err := strconv.ParseFloat(headerHint(r, "Sec-CH-DPR", "DPR"), 64)
+		if err != nil || dpr <= 0 { dpr = 1 }
+		dw := int(float64(vw) * dpr)
+
+		// only ever smaller than the default
+		if !cfg.resize.enabled || dw < cfg.resize.width {
+			for _, name := range presetNames() {
+				if p := Presets[name]; p.enabled && p.width >= dw && (!cfg.resize.enabled || p.width < cfg.resize.width) {
+					return name, p
+				}
+			}
+		}
+	}
+
+	return strings.ToLower(cfg.pstr), cfg.resize
+}
+
+func headerHint(r *http.Request, names ...string) string {
+	for _, n := range names {
+		if v := r.Header.Get(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// preset names by width, none first
+func presetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := Presets[names[i]], Presets[names[j]]
+		if pi.enabled != pj.enabled {
+			return !pi.enabled
+		}
+		if pi.width != pj.width {
+			return pi.width < pj.width
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
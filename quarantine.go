@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// files that crashed a worker, timed out or failed repeatedly
+// persisted in the cache directory so pathological files aren't retried on every start
+type failure struct {
+	Path        string    `json:"path"`
+	Reason      string    `json:"reason"`
+	Count       int       `json:"count"`
+	Quarantined bool      `json:"quarantined"`
+	ModTime     int64     `json:"modTime"`
+	Time        time.Time `json:"time"`
+}
+
+type quarantineList struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex
+	path    string
+	entries map[string]*failure
+}
+
+func loadQuarantine(path string) *quarantineList {
+	q := &quarantineList{path: path, entries: make(map[string]*failure)}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return q
+	}
+	var list []*failure
+	if json.Unmarshal(buf, &list) == nil {
+		for _, f := range list {
+			q.entries[f.Path] = f
+		}
+	}
+	return q
+}
+
+func modTimeOf(fp string) int64 {
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return 0
+	}
+	return fi.ModTime().Unix()
+}
+
+// reports whether fp is quarantined; a file modified since is given another chance
+func (q *quarantineList) blocked(fp string) bool {
+	q.mu.Lock()
+	f, ok := q.entries[fp]
+	q.mu.Unlock()
+	if !ok || !f.Quarantined {
+		return false
+	}
+	return f.ModTime == modTimeOf(fp)
+}
+
+// records a decode failure; fatal failures (crash, timeout) quarantine immediately
+func (q *quarantineList) add(fp string, reason string, fatal bool) {
+	mt := modTimeOf(fp)
+
+	q.mu.Lock()
+	f, ok := q.entries[fp]
+	if !ok || f.ModTime != mt {
+		f = &failure{Path: fp, ModTime: mt}
+		q.entries[fp] = f
+	}
+	f.Count++
+	f.Reason = reason
+	f.Time = time.Now()
+	quarantined := !f.Quarantined && (fatal || f.Count >= int(cfg.maxFails))
+	if quarantined {
+		f.Quarantined = true
+	}
+	count := f.Count
+	q.mu.Unlock()
+
+	if quarantined {
+		slog.Warn("quarantined", "path", fp, "failures", count)
+	}
+
+	q.save()
+}
+
+func (q *quarantineList) list() []failure {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]failure, 0, len(q.entries))
+	for _, f := range q.entries {
+		list = append(list, *f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list
+}
+
+func (q *quarantineList) save() {
+	buf, err := json.MarshalIndent(q.list(), "", "\t")
+	if err != nil {
+		return
+	}
+	q.saveMu.Lock()
+	defer q.saveMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return
+	}
+
+	writeFileAtomic(q.path, buf, 0644)
+}
+
+func failuresHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quarantine.list())
+}
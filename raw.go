@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"thumbnailer/vips"
+)
+
+// embedded previews of raw files
+// the largest jpeg found in the container is used in place of a full (dcraw) decode
+// unless it would be upscaled (some dng only embed 256 px)
+
+const previewMinSize = 1280 // lightbox without resize preset, longer side
+
+var (
+	uuidCanonPreview = []byte{0xea, 0xf4, 0x2b, 0x5e, 0x1c, 0x98, 0x4b, 0x88, 0xb9, 0xfb, 0xb7, 0xdc, 0x40, 0x6e, 0x4d, 0x16}
+	uuidCanonMeta    = []byte{0x85, 0xc0, 0xb6, 0x87, 0x82, 0x0f, 0x11, 0xe0, 0x81, 0x11, 0xf4, 0xce, 0x46, 0x2b, 0x6a, 0x48}
+)
+
+type jpegPreview struct {
+	buf    []byte
+	orient int // to apply, 1 if the preview carries its own
+	width  int
+	height int
+}
+
+func getRawPreview(fp string) (*jpegPreview, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []jpegRef
+	orient := 1
+
+	var magic [16]byte
+	if _, err := f.ReadAt(magic[:], 0); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case string(magic[:]) == "FUJIFILMCCD-RAW ": // raf
+		var b [8]byte
+		if _, err := f.ReadAt(b[:], 84); err != nil {
+			return nil, err
+		}
+		refs = append(refs, jpegRef{int64(binary.BigEndian.Uint32(b[:])), int64(binary.BigEndian.Uint32(b[4:]))})
+
+	case string(magic[4:12]) == "ftypcrx ": // cr3
+		refs, orient = cr3Preview(f, fi.Size())
+
+	default: // tiff based
+		t, err := newTiffReader(f, 0)
+		if err != nil {
+			return nil, errNoPreview
+		}
+		refs = t.jpegs(t.ifd0, 0)
+		orient, _ = t.orientation()
+	}
+
+	var best *jpegRef
+	var bw, bh int
+	for i, ref := range refs {
+		if ref.off <= 0 || ref.length <= 0 || ref.off+ref.length > fi.Size() {
+			continue
+		}
+		w, h, ok := jpegSize(f, ref.off)
+		if ok && w*h > bw*bh {
+			best, bw, bh = &refs[i], w, h
+		}
+	}
+	if best == nil {
+		return nil, errNoPreview
+	}
+
+	buf := make([]byte, best.length)
+	if _, err := f.ReadAt(buf, best.off); err != nil {
+		return nil, err
+	}
+
+	// a preview with its own exif orientation is rotated by libvips (or the browser)
+	if t, err := jpegExif(bytes.NewReader(buf)); err == nil {
+		if _, ok := t.orientation(); ok {
+			orient = 1
+		}
+	}
+	if orient >= 5 {
+		bw, bh = bh, bw
+	}
+
+	return &jpegPreview{buf: buf, orient: orient, width: bw, height: bh}, nil
+}
+
+// iso bmff boxes within [off, end)
+func eachBox(r io.ReaderAt, off, end int64, fn func(typ string, payload, size int64) bool) {
+	var b [16]byte
+	for off+8 <= end {
+		if _, err := r.ReadAt(b[:8], off); err != nil {
+			return
+		}
+		size := int64(binary.BigEndian.Uint32(b[:]))
+		typ := string(b[4:8])
+		payload := off + 8
+		if size == 1 {
+			if _, err := r.ReadAt(b[8:16], off+8); err != nil {
+				return
+			}
+			size = int64(binary.BigEndian.Uint64(b[8:]))
+			payload += 8
+		} else if size == 0 {
+			size = end - off
+		}
+		if size < 8 || off+size > end {
+			return
+		}
+		if !fn(typ, payload, off+size) {
+			return
+		}
+		off += size
+	}
+}
+
+// canon cr3: PRVW jpeg in the preview uuid box, orientation in moov/uuid/CMT1 (tiff ifd0)
+func cr3Preview(r io.ReaderAt, size int64) ([]jpegRef, int) {
+	var refs []jpegRef
+	orient := 1
+	uuid := make([]byte, 16)
+
+	eachBox(r, 0, size, func(typ string, payload, end int64) bool {
+		switch typ {
+		case "uuid":
+			if _, err := r.ReadAt(uuid, payload); err != nil || !bytes.Equal(uuid, uuidCanonPreview) {
+				break
+			}
+			// PRVW follows a short header; the jpeg starts within its first bytes
+			head := make([]byte, 96)
+			n, _ := r.ReadAt(head, payload+16)
+			head = head[:n]
+			if i := bytes.Index(head, []byte("PRVW")); i >= 4 {
+				boxEnd := payload + 16 + int64(i-4) + int64(binary.BigEndian.Uint32(head[i-4:]))
+				if j := bytes.Index(head[i:], []byte{0xff, 0xd8, 0xff}); j >= 0 {
+					off := payload + 16 + int64(i+j)
+					refs = append(refs, jpegRef{off, boxEnd - off})
+				}
+			}
+		case "moov":
+			eachBox(r, payload, end, func(typ string, payload, end int64) bool {
+				if typ != "uuid" {
+					return true
+				}
+				if _, err := r.ReadAt(uuid, payload); err != nil || !bytes.Equal(uuid, uuidCanonMeta) {
+					return true
+				}
+				eachBox(r, payload+16, end, func(typ string, payload, end int64) bool {
+					if typ == "CMT1" {
+						if t, err := newTiffReader(r, payload); err == nil {
+							orient, _ = t.orientation()
+						}
+						return false
+					}
+					return true
+				})
+				return false
+			})
+		}
+		return true
+	})
+	return refs, orient
+}
+
+// applies an exif orientation
+func orientImage(img *vips.Image, orient int) error {
+	var err error
+	switch orient {
+	case 2:
+		err = img.Flip(vips.DirectionHorizontal)
+	case 3:
+		err = img.Rot(vips.AngleD180)
+	case 4:
+		err = img.Flip(vips.DirectionVertical)
+	case 5:
+		if err = img.Rot(vips.AngleD90); err == nil {
+			err = img.Flip(vips.DirectionHorizontal)
+		}
+	case 6:
+		err = img.Rot(vips.AngleD90)
+	case 7:
+		if err = img.Rot(vips.AngleD90); err == nil {
+			err = img.Flip(vips.DirectionVertical)
+		}
+	case 8:
+		err = img.Rot(vips.AngleD270)
+	}
+	return err
+}
+
+// thumbnail or lightbox image from the embedded preview
+func getRawPreviewImage(fp string, fi *FileInfo, thumbnail bool, o DecodeOpts) ([]byte, string, error) {
+	defer observeDecode("preview", normExt(fp), time.Now())
+
+	p, err := getRawPreview(fp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	small := false
+	switch {
+	case thumbnail:
+		small = p.width < o.Width
+	case o.Fit.Width > 0: // covering the fit box in either dimension
+		small = p.width < o.Fit.Width && p.height < o.Fit.Height
+	default:
+		small = max(p.width, p.height) < previewMinSize
+	}
+	if small {
+		return nil, "", errPreviewSmall
+	}
+
+	mpx := float64(p.width * p.height) / 1000000.0
+	if thumbnail { fi.mpx = mpx }
+
+	return previewImage(p, thumbnail, o)
+}
+
+// decodes an embedded jpeg preview, applying its orientation
+// the preview is served as is if neither rotation nor resizing is required
+func previewImage(p *jpegPreview, thumbnail bool, o DecodeOpts) ([]byte, string, error) {
+	var err error
+	mpx := float64(p.width * p.height) / 1000000.0
+
+	var w, h int
+	var crop vips.Interesting
+	if thumbnail {
+		w, h, crop = thumbBox(o)
+	} else if o.Fit.Width > 0 && mpx > o.Fit.Mpx {
+		w, h = o.Fit.Width, o.Fit.Height
+	} else if p.orient == 1 && o.Rotate == 0 {
+		return p.buf, "image/jpeg", nil
+	}
+
+	var img *vips.Image
+	if w > 0 {
+		// bounds apply before rotation
+		if p.orient >= 5 { w, h = h, w }
+		img, err = vips.NewThumbnailBuffer(p.buf, w, &vips.ThumbnailBufferOptions{ Height: h, Crop: crop, Size: vips.SizeDown })
+	} else {
+		img, err = vips.NewImageFromBuffer(p.buf, nil)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer img.Close()
+
+	if err := orientImage(img, p.orient); err != nil {
+		return nil, "", err
+	}
+
+	return encode(img, o)
+}
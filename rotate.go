@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"thumbnailer/vips"
+)
+
+// persistent rotation (-rotate)
+// sidecar: clockwise degrees per file, kept in the cache directory and applied on decode
+// exif: the orientation tag of jpeg files is rewritten (lossless), the sidecar is the fallback
+
+var (
+	errNoOrientation = errors.New("no orientation tag")
+	exifMu           sync.Mutex // rotateExif reads, modifies and writes the file
+)
+
+type rotationList struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]int
+}
+
+func loadRotations(path string) *rotationList {
+	l := &rotationList{path: path, entries: make(map[string]int)}
+
+	if buf, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(buf, &l.entries)
+	}
+	return l
+}
+
+// clockwise degrees applied on top of the exif orientation
+func (l *rotationList) get(fp string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.entries[fp]
+}
+
+func (l *rotationList) rotate(fp string, deg int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if deg = (l.entries[fp] + deg) % 360; deg == 0 {
+		delete(l.entries, fp)
+	} else {
+		l.entries[fp] = deg
+	}
+
+	buf, err := json.MarshalIndent(l.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path, buf, 0644)
+}
+
+// carries the rotation over to a moved or renamed file
+func (l *rotationList) rename(from, to string) {
+	l.mu.Lock()
+	deg, ok := l.entries[from]
+	l.mu.Unlock()
+	if ok {
+		l.rotate(from, 360-deg)
+		l.rotate(to, deg)
+	}
+}
+
+// writes via a temporary file in the same directory, renamed over fp
+func writeFileAtomic(fp string, buf []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(fp), "."+filepath.Base(fp)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// exif orientations as 2x2 matrices (y pointing down), index: orientation
+var orientMatrix = [9][4]int{
+	{},
+	{1, 0, 0, 1},   // upright
+	{-1, 0, 0, 1},  // flip horizontal
+	{-1, 0, 0, -1}, // 180
+	{1, 0, 0, -1},  // flip vertical
+	{0, 1, 1, 0},   // transpose
+	{0, -1, 1, 0},  // 90 cw
+	{0, -1, -1, 0}, // transverse
+	{0, 1, -1, 0},  // 270 cw
+}
+
+// orientation after rotating an image of orientation orient by deg clockwise
+func rotateOrientation(orient, deg int) int {
+	r := orientMatrix[map[int]int{0: 1, 90: 6, 180: 3, 270: 8}[deg]]
+	m := orientMatrix[orient]
+	p := [4]int{r[0]*m[0] + r[1]*m[2], r[0]*m[1] + r[1]*m[3], r[2]*m[0] + r[3]*m[2], r[2]*m[1] + r[3]*m[3]}
+
+	for i := 1; i < len(orientMatrix); i++ {
+		if orientMatrix[i] == p {
+			return i
+		}
+	}
+	return orient
+}
+
+// rewrites the orientation tag of a jpeg in place; errNoOrientation if there is none to rewrite
+func rotateExif(fp string, deg int) error {
+	exifMu.Lock()
+	defer exifMu.Unlock()
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+
+	t, err := jpegExif(bytes.NewReader(buf))
+	if err != nil {
+		return errNoOrientation
+	}
+	off, orient, ok := t.orientationEntry()
+	if !ok {
+		return errNoOrientation
+	}
+
+	t.bo.PutUint16(buf[off:], uint16(rotateOrientation(orient, deg)))
+	return writeFileAtomic(fp, buf, fi.Mode().Perm())
+}
+
+// rotates img by a multiple of 90 degrees clockwise
+func rotateImage(img *vips.Image, deg int) error {
+	switch deg {
+	case 90:
+		return img.Rot(vips.AngleD90)
+	case 180:
+		return img.Rot(vips.AngleD180)
+	case 270:
+		return img.Rot(vips.AngleD270)
+	}
+	return nil
+}
+
+// POST /rotate/{id}?deg=90|180|270
+func rotateHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/rotate/"))
+	fi, ok := indexedFile(id)
+	if err != nil || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	deg, err := strconv.Atoi(r.URL.Query().Get("deg"))
+	if deg = (deg % 360 + 360) % 360; err != nil || deg % 90 != 0 {
+		http.Error(w, "Invalid rotation", http.StatusBadRequest)
+		return
+	}
+	fp := fi.Path
+
+	if ext := normExt(fp); cfg.rotate == "exif" && (ext == "jpg" || ext == "jpeg") {
+		err = rotateExif(fp, deg)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !errors.Is(err, errNoOrientation) {
+			http.Error(w, "Unable to rotate: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := rotations.rotate(fp, deg); err != nil {
+		http.Error(w, "Unable to rotate: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// bounds the number of concurrent decodes (libvips, MuPDF, libmobi)
+// waiting requests are granted newest first (lifo) per default, so that tiles
+// scrolled into view last are decoded before the ones the client already left behind
+type scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	lifo    bool
+	queue   []chan struct{}
+	paused  bool
+	idle    chan struct{} // closed once paused and no decode is running
+}
+
+func newScheduler(limit int, lifo bool) *scheduler {
+	if limit < 1 { limit = 1 }
+	return &scheduler{limit: limit, lifo: lifo}
+}
+
+// blocks until a decode slot is available or ctx is done
+// a request abandoned by the client is dropped from the queue without ever decoding
+func (s *scheduler) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.running < s.limit && !s.paused {
+		s.running++
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	s.queue = append(s.queue, ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for i, c := range s.queue {
+			if c == ch {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				s.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		s.mu.Unlock()
+
+		// the slot was handed over while cancelling; pass it on
+		s.release()
+		return ctx.Err()
+	}
+}
+
+// hands the slot to the next waiting request, if any
+func (s *scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 || s.paused {
+		s.running--
+		if s.running == 0 && s.idle != nil {
+			close(s.idle)
+			s.idle = nil
+		}
+		return
+	}
+	close(s.next())
+}
+
+// dequeues the next waiting request
+func (s *scheduler) next() chan struct{} {
+	var ch chan struct{}
+	n := len(s.queue)
+	if s.lifo {
+		ch = s.queue[n-1]
+		s.queue = s.queue[:n-1]
+	} else {
+		ch = s.queue[0]
+		s.queue = s.queue[1:]
+	}
+	return ch
+}
+
+// stops granting slots and waits for running decodes to complete or ctx to be done
+// queued requests keep waiting until resume
+func (s *scheduler) pause(ctx context.Context) error {
+	s.mu.Lock()
+	s.paused = true
+	idle := s.idle
+	if s.running > 0 && idle == nil {
+		idle = make(chan struct{})
+		s.idle = idle
+	}
+	s.mu.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// grants the slots held back while paused
+func (s *scheduler) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = false
+	for s.running < s.limit && len(s.queue) > 0 {
+		s.running++
+		close(s.next())
+	}
+}
+
+// running and waiting decodes
+func (s *scheduler) stats() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running, len(s.queue)
+}
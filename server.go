@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	indexing   atomic.Bool  // initial walk, the index grows while serving
+	indexDirs  atomic.Int64 // walk progress
+	indexFiles atomic.Int64
+	reindexing atomic.Bool
+)
+
+// walk progress; the index is extended per directory, in flat mode it is sorted and set once complete
+// the new entries are copied, the walker keeps appending to its own slice
+func publishIndex(infos []FileInfo, dcnt uint) {
+	indexDirs.Store(int64(dcnt))
+	indexFiles.Store(int64(len(infos)) - int64(dcnt))
+	if cfg.flat {
+		return
+	}
+	indexMu.Lock()
+	fileInfos = append(fileInfos, infos[len(fileInfos):]...)
+	indexLen = len(fileInfos)
+	indexMu.Unlock()
+}
+
+type progress struct {
+	Indexing bool   `json:"indexing"`
+	Dirs     int64  `json:"dirs"`
+	Files    int64  `json:"files"`
+	Next     int    `json:"next"`             // from for the next poll
+	HTML     string `json:"html,omitempty"`   // grid markup of entries [from, next)
+	Reload   bool   `json:"reload,omitempty"` // flat mode, once complete
+}
+
+// GET /progress?from={n}: walk progress and, in single page mode, the entries indexed since n
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	p := progress{Indexing: indexing.Load(), Dirs: indexDirs.Load(), Files: indexFiles.Load(), Next: from}
+
+	indexMu.RLock()
+	if from >= 0 && from < indexLen {
+		switch {
+		case cfg.flat:
+			p.Reload = !p.Indexing
+		case cfg.single:
+			var b strings.Builder
+			writeList(&b, fileInfos[from:indexLen])
+			p.HTML, p.Next = b.String(), indexLen
+		default: // the first directory page is available
+			p.Reload = true
+		}
+	}
+	indexMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// SIGINT, SIGTERM: stops accepting connections, then waits up to -drain for requests
+// (ex. downloads) and decodes; libvips is shut down by main thereafter
+// a second signal exits at once
+func shutdown(srv *http.Server, sig os.Signal) {
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	slog.Info("shutting down", "signal", sig.String(), "drain", cfg.drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.drain)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("requests cut off", "err", err)
+		srv.Close()
+	}
+	// decodes may outlive their request (coalesced, client gone)
+	if err := sched.pause(ctx); err != nil {
+		// libvips and MuPDF are still in use; skip their cleanup
+		slog.Warn("decodes still running, exiting", "err", err)
+		os.Exit(1)
+	}
+	if pool != nil {
+		pool.close()
+	}
+}
+
+// SIGHUP: walks the root again and swaps in the new index under indexMu, the listener is kept
+// decodes address files by id and are drained for the swap; handlers read copies of the entries
+// open pages need a reload
+func reindex() {
+	if indexing.Load() || !reindexing.CompareAndSwap(false, true) {
+		slog.Info("indexing already running")
+		return
+	}
+	defer reindexing.Store(false)
+
+	slog.Info("reindexing", "root", cfg.root)
+	start := time.Now()
+
+	infos, dcnt, err := walkDir(cfg.root, make(chan struct{}), nil)
+	if err != nil {
+		slog.Error("reindex failed", "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	defer sched.resume()
+	if err := sched.pause(ctx); err != nil {
+		slog.Warn("reindex discarded, decodes still running", "err", err)
+		return
+	}
+
+	indexMu.Lock()
+	fileInfos, indexLen = infos, len(infos)
+	dirMenu = cfg.lsd && dcnt > 1
+	indexMu.Unlock()
+
+	slog.Info("reindexed", "dirs", dcnt, "entries", len(infos), "took", time.Since(start).Round(time.Millisecond))
+}
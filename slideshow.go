@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /slideshow?dir={id}|q={search}|album={name}&interval={s}&shuffle=1&seed={n}&start={i}&preset={name}
+// cycles through a directory (recursive), a search (case-insensitive, path) or album, or the whole index
+// documents are skipped; images are preloaded through /image with the active (or given) preset
+func slideshowHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var files []FileInfo
+	for _, itm := range displayOrder() {
+		if itm.isFile && itm.cType != "doc" {
+			files = append(files, itm)
+		}
+	}
+
+	switch {
+	case q.Get("album") != "":
+		paths, ok := albums.entries(q.Get("album"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		byPath := make(map[string]FileInfo, len(files))
+		for _, itm := range files {
+			byPath[relPath(itm.Path)] = itm
+		}
+		files = files[:0]
+		for _, p := range paths {
+			if itm, ok := byPath[p]; ok {
+				files = append(files, itm)
+			}
+		}
+	case q.Get("dir") != "":
+		id, err := strconv.Atoi(q.Get("dir"))
+		dir, ok := indexedDir(id)
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		prefix := dir.Path + string(filepath.Separator)
+		files = filterFiles(files, func(itm FileInfo) bool { return strings.HasPrefix(itm.Path, prefix) })
+	case q.Get("q") != "":
+		term := strings.ToLower(q.Get("q"))
+		files = filterFiles(files, func(itm FileInfo) bool { return strings.Contains(strings.ToLower(itm.Path), term) })
+	}
+
+	// a seed keeps the order across reloads; picked and handed to the page if not given
+	seed, err := strconv.ParseInt(q.Get("seed"), 10, 64)
+	if q.Get("shuffle") != "" {
+		if err != nil {
+			seed = time.Now().UnixNano() % 1000000
+		}
+		rnd := rand.New(rand.NewSource(seed))
+		rnd.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	}
+
+	interval := cfg.interval
+	if v, err := strconv.ParseFloat(q.Get("interval"), 64); err == nil && v >= 1 {
+		interval = time.Duration(v * float64(time.Second))
+	}
+
+	ids := make([]int, len(files))
+	for i, itm := range files {
+		ids[i] = itm.ID
+	}
+	list, _ := json.Marshal(ids)
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Accept-CH", "Sec-CH-Viewport-Width, Sec-CH-DPR, Viewport-Width, DPR")
+	fmt.Fprintf(w, `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>thumbnailer :: slideshow</title>
+<link rel="icon" type="image/x-icon" href="/static/favicon.ico">
+<link rel="stylesheet" href="/static/style.css">
+<script src="/static/slideshow.js" defer></script>
+</head>
+<body class="slideshow" data-interval="%d" data-viewport="%t" data-seed="%d">
+<img id="slideA" /><img id="slideB" />
+<div id="slideInfo"></div>
+<script type="application/json" id="slides">%s</script>
+</body>
+</html>`, interval.Milliseconds(), cfg.viewport, seed, list)
+}
+
+func filterFiles(files []FileInfo, keep func(FileInfo) bool) []FileInfo {
+	var res []FileInfo
+	for _, itm := range files {
+		if keep(itm) {
+			res = append(res, itm)
+		}
+	}
+	return res
+}
@@ -16,7 +16,7 @@ document.addEventListener("DOMContentLoaded", ev => {
 	const dFit = document.body.dataset.fit == "true";
 	const maxHeight = window.innerHeight * 0.85;
 
-    const images = document.querySelectorAll('ul.flex li img');
+    const images = document.querySelectorAll('ul.flex li:not(.missing) img');
 	const lightbox = document.getElementById('lightbox');
 	const lightboxImage = document.getElementById('lightboxImage');
 	const lightboxClose = document.getElementById('lightboxClose');
@@ -77,6 +77,7 @@ document.addEventListener("DOMContentLoaded", ev => {
 	const loadImage = (entry, observer) => {
 		const img = entry.target;
 		const container = img.parentNode;
+		if (img.dataset.srcset) img.srcset = img.dataset.srcset; // hidpi
 		img.src = `/thumbnail/${img.dataset.id}`;
 
 		img.onload = () => {
@@ -112,6 +113,49 @@ document.addEventListener("DOMContentLoaded", ev => {
 		threshold: 0.1           // trigger when 10% of the image is in the viewport
 	});
 
+	// server-side fit to the viewport
+	const viewportQuery = () => {
+		if (document.body.dataset.viewport != "true") return "";
+		return `?vw=${window.innerWidth}&vh=${window.innerHeight}&dpr=${window.devicePixelRatio || 1}`;
+	};
+
+	// lightbox source; v busts the browser cache after a persisted rotation
+	const imageSrc = (id, extra="") => {
+		const q = new URLSearchParams(viewportQuery() + extra);
+		const img = document.querySelector(`ul.flex li img[data-id='${id}']`);
+		if (img && img.dataset.v) q.set("v", img.dataset.v);
+		return q.toString() ? `/image/${id}?${q}` : `/image/${id}`;
+	};
+
+	// persist the rotation (-rotate); the re-encoded images replace the css transform
+	const persistRotation = (id, deg) => {
+		fetch(`/rotate/${id}?deg=${deg}`, {
+			method: "POST",
+			headers: {"Content-Type": "application/json"}
+		}).then(res => {
+			if (!res.ok) return;
+
+			const img = document.querySelector(`ul.flex li img[data-id='${id}']`);
+			const v = Date.now();
+			img.dataset.v = v;
+			img.dataset.srcset = `/thumbnail/${id}?v=${v} 1x, /thumbnail/${id}?dpr=2&v=${v} 2x`;
+			if (img.srcset) {
+				img.srcset = img.dataset.srcset;
+				img.src = `/thumbnail/${id}?v=${v}`;
+			}
+
+			if (lightboxImage.dataset.id != id) {
+				delete rot[id];
+				return;
+			}
+			lightboxImage.addEventListener("load", () => {
+				delete rot[id];
+				transform(true, id);
+			}, { once: true });
+			lightboxImage.src = imageSrc(id);
+		});
+	};
+
 	const openLightbox = (img) => {
 		const showNewImage = () => {
 			lightboxImage.style.transition = 'none';
@@ -124,7 +168,7 @@ document.addEventListener("DOMContentLoaded", ev => {
 			transform(true, img.dataset.id);
 
 			void lightboxImage.offsetWidth; // force re-flow
-			lightboxImage.src = `/image/${img.dataset.id}${(img.dataset.ct == "raw" ? "?retry=1" : "")}`;
+			lightboxImage.src = imageSrc(img.dataset.id);
 
 			requestAnimationFrame(() => {
 				lightboxImage.style.transition = "";
@@ -153,7 +197,7 @@ document.addEventListener("DOMContentLoaded", ev => {
 		if (lightboxImage.src.includes("retry=1")) {
 			return;
 		}
-		lightboxImage.src = `/image/${lightboxImage.dataset.id}?retry=1`;
+		lightboxImage.src = imageSrc(lightboxImage.dataset.id, "&retry=1");
 	};
 
 	// attach handlers
@@ -163,13 +207,255 @@ document.addEventListener("DOMContentLoaded", ev => {
 		lightbox.style.display = 'none';
 	});
 
-    images.forEach(img => {
+	// zip download via a form post, selections may be large
+	const download = (ids, resized) => {
+		if (!ids.length) return;
+		const form = document.createElement("form");
+		form.method = "POST";
+		form.action = "/download";
+		const fields = {ids: ids.join(","), resized: resized ? "1" : ""};
+		if (document.body.dataset.album) fields.name = document.body.dataset.album;
+		for (const [k, v] of Object.entries(fields)) {
+			const input = document.createElement("input");
+			input.type = "hidden";
+			input.name = k;
+			input.value = v;
+			form.appendChild(input);
+		}
+		document.body.appendChild(form);
+		form.submit();
+		form.remove();
+	};
+
+	// tiles shown, respecting filters
+	const shownIds = () => [...document.querySelectorAll("ul.flex li:not(.filtered):not(.missing) img")].map(img => img.dataset.id);
+
+	// multi-select (-manage)
+	const selectbar = document.getElementById("selectbar");
+	let selecting = false;
+	let lastSelected = null;
+
+	const selected = () => [...document.querySelectorAll("ul.flex li.selected img")];
+
+	// move and copy targets, loaded once selecting
+	let targetsLoaded = false;
+	const loadTargets = () => {
+		if (targetsLoaded) return;
+		targetsLoaded = true;
+		fetch("/dirs?all=1").then(res => res.json()).then(nodes => {
+			const sel = document.getElementById("selectDir");
+			nodes.forEach(n => sel.add(new Option(n.name, n.id)));
+		});
+	};
+
+	const setSelecting = (on) => {
+		selecting = on;
+		if (on) loadTargets();
+		selectbar.classList.toggle("hidden", !on);
+		if (!on) document.querySelectorAll("ul.flex li.selected").forEach(li => li.classList.remove("selected"));
+		lastSelected = null;
+		document.getElementById("selectCount").textContent = 0;
+	};
+
+	// shift selects the range from the last toggled tile
+	const toggleSelect = (li, range) => {
+		if (range && lastSelected) {
+			const all = [...document.querySelectorAll("ul.flex li")];
+			const [a, b] = [all.indexOf(lastSelected), all.indexOf(li)].sort((x, y) => x - y);
+			all.slice(a, b + 1).forEach(el => el.classList.add("selected"));
+		} else {
+			li.classList.toggle("selected");
+		}
+		lastSelected = li;
+		document.getElementById("selectCount").textContent = selected().length;
+	};
+
+	const manage = (op, body) => fetch(`/manage/${op}`, {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify(body)
+	}).then(res => res.json()).then(results => {
+		const failed = results.filter(r => r.error);
+		if (failed.length) alert(failed.map(r => `${document.querySelector(`ul.flex li img[data-id='${r.id}']`).title}: ${r.error}`).join("\n"));
+		return results.filter(r => !r.error);
+	});
+
+	if (selectbar) {
+		selectbar.addEventListener("click", ev => {
+			const op = ev.target.dataset.op;
+			if (!op) return;
+			const ids = selected().map(img => parseInt(img.dataset.id, 10));
+
+			switch (op) {
+				case "done":
+					setSelecting(false);
+					return;
+				case "download":
+				case "download-resized":
+					download(ids, op == "download-resized");
+					return;
+				case "trash":
+					if (!ids.length || !confirm(`Move ${ids.length} file(s) to the trash?`)) return;
+					manage("trash", {ids: ids}).then(done => {
+						done.forEach(r => document.querySelector(`ul.flex li img[data-id='${r.id}']`).parentElement.remove());
+						setSelecting(true);
+					});
+					break;
+				case "move":
+				case "copy":
+					const dir = document.getElementById("selectDir").value;
+					if (!ids.length || dir === "") return;
+					manage(op, {ids: ids, dir: parseInt(dir, 10)}).then(done => {
+						if (done.length) location.reload(); // new tiles are placed server-side
+					});
+					break;
+				case "rename":
+					if (ids.length != 1) {
+						alert("Select a single file to rename.");
+						return;
+					}
+					const img = selected()[0];
+					const span = img.parentElement.querySelector("span.name");
+					const name = prompt("New name:", span.textContent);
+					if (!name || name == span.textContent) return;
+					manage("rename", {ids: ids, name: name}).then(done => {
+						if (!done.length) return;
+						img.title = img.title.slice(0, img.title.length - span.textContent.length) + name; // name or path
+						span.textContent = name;
+					});
+					break;
+			}
+		});
+
+		document.addEventListener("keydown", ev => {
+			if (lightbox.style.display === 'flex' || ev.target.tagName == "INPUT" || ev.target.tagName == "SELECT") return;
+			if (ev.key === "m") setSelecting(!selecting);
+			else if (ev.key === "Escape" && selecting) setSelecting(false);
+		});
+	}
+
+	// ratings, labels and tags (-xmp)
+	const labels = ["red", "yellow", "green", "blue", "purple"];
+	let hovered = null;
+	let filter = { rating: 0, label: "" };
+
+	const setMeta = (li, meta) => {
+		const id = li.querySelector("img").dataset.id;
+		return fetch(`/meta/${id}`, {
+			method: "POST",
+			headers: {"Content-Type": "application/json"},
+			body: JSON.stringify(meta)
+		}).then(res => res.ok ? res.json() : res.text().then(t => Promise.reject(t))).then(m => {
+			li.dataset.rating = m.rating;
+			li.dataset.label = m.label;
+			li.dataset.tags = (m.tags || []).join(", ");
+			applyFilter();
+		}).catch(error => console.error("Meta -> Error:", error));
+	};
+
+	// 0-5: rating, shift+1-5: label (shift+0 clears), t: tags
+	const metaKey = (ev, lis) => {
+		if (document.body.dataset.xmp != "true" || !lis.length) return false;
+		let meta;
+		if (ev.shiftKey && /^Digit[0-5]$/.test(ev.code)) {
+			const n = parseInt(ev.code.slice(5), 10);
+			meta = { label: n ? labels[n - 1] : "" };
+			if (n && lis.every(li => li.dataset.label == meta.label)) meta.label = ""; // toggle
+		} else if (/^[0-5]$/.test(ev.key)) {
+			meta = { rating: parseInt(ev.key, 10) };
+		} else if (ev.key === "t") {
+			const tags = prompt("Tags (comma separated):", lis[0].dataset.tags);
+			if (tags === null) return true;
+			meta = { tags: tags.split(",").map(t => t.trim()).filter(t => t) };
+		} else {
+			return false;
+		}
+		ev.preventDefault();
+		lis.forEach(li => setMeta(li, meta));
+		return true;
+	};
+
+	const applyFilter = () => {
+		document.querySelectorAll("ul.flex li[data-rating]").forEach(li => {
+			const hide = parseInt(li.dataset.rating, 10) < filter.rating || (filter.label && li.dataset.label != filter.label);
+			li.classList.toggle("filtered", hide);
+		});
+	};
+
+	// stable, by rating desc; the original order is kept in data-order
+	const sortByRating = (on) => {
+		document.querySelectorAll("ul.flex").forEach(ul => {
+			const lis = [...ul.children];
+			lis.forEach((li, i) => { if (li.dataset.order === undefined) li.dataset.order = i; });
+			lis.sort((a, b) => on ? (b.dataset.rating - a.dataset.rating) || (a.dataset.order - b.dataset.order) : a.dataset.order - b.dataset.order);
+			lis.forEach(li => ul.appendChild(li));
+		});
+	};
+
+	// next or previous tile, skipping filtered ones
+	const sibling = (el, next) => {
+		do {
+			el = next ? el.nextElementSibling : el.previousElementSibling;
+		} while (el && (el.classList.contains("filtered") || el.classList.contains("missing")));
+		return el;
+	};
+
+	// albums; a: add to an album (prompted, last one by default), x: remove from the album shown
+	const album = document.body.dataset.album;
+
+	const albumKey = (ev, lis) => {
+		if (!lis.length || (ev.key !== "a" && !(ev.key === "x" && album))) return false;
+		ev.preventDefault();
+
+		let name = album;
+		if (ev.key === "a") {
+			name = prompt("Add to album:", localStorage.album || "");
+			if (!name || !name.trim()) return true;
+			name = name.trim();
+			localStorage.album = name;
+		}
+		const ids = lis.filter(li => li.querySelector("img").dataset.id).map(li => parseInt(li.querySelector("img").dataset.id, 10));
+		const paths = lis.filter(li => li.dataset.path).map(li => li.dataset.path);
+
+		fetch(`/album/${encodeURIComponent(name)}/${ev.key === "a" ? "add" : "remove"}`, {
+			method: "POST",
+			headers: {"Content-Type": "application/json"},
+			body: JSON.stringify({ids: ids, paths: paths})
+		}).then(res => {
+			if (!res.ok) return res.text().then(t => alert(t));
+			if (ev.key === "x") lis.forEach(li => li.remove());
+		});
+		return true;
+	};
+
+	document.addEventListener("keydown", ev => {
+		if (lightbox.style.display === 'flex' || ev.target.tagName == "INPUT" || ev.target.tagName == "SELECT") return;
+		const lis = selecting && document.querySelector("ul.flex li.selected")
+			? [...document.querySelectorAll("ul.flex li.selected")]
+			: (hovered ? [hovered] : []);
+		metaKey(ev, lis) || albumKey(ev, lis);
+	});
+
+	// album entries of files gone missing
+	document.querySelectorAll('ul.flex li.missing').forEach(li => {
+		li.addEventListener('mouseenter', () => { hovered = li; });
+		li.addEventListener('mouseleave', () => { if (hovered === li) hovered = null; });
+	});
+
+	const initTile = img => {
 		// lazy-loading
 		observer.observe(img);
 
+		img.parentNode.addEventListener('mouseenter', () => { hovered = img.parentNode; });
+		img.parentNode.addEventListener('mouseleave', () => { if (hovered === img.parentNode) hovered = null; });
+
 		// lightbox
 		img.parentNode.addEventListener('click', ev => {
 			ev.preventDefault();
+			if (selecting) {
+				toggleSelect(img.parentNode, ev.shiftKey);
+				return;
+			}
 			openLightbox(img);
 		});
 
@@ -186,7 +472,8 @@ document.addEventListener("DOMContentLoaded", ev => {
                 console.error("Context open -> Error:", error);
             });
         });
-    });
+	};
+	images.forEach(initTile);
 
 	lightboxClose.addEventListener('click', () => {
 		lightbox.style.display = 'none';
@@ -208,11 +495,11 @@ document.addEventListener("DOMContentLoaded", ev => {
 		switch (true) {
 			case ev.key === "ArrowRight":
 				ev.preventDefault();
-				nextListItem = el.nextElementSibling;
+				nextListItem = sibling(el, true);
 				break;
 			case ev.key === "ArrowLeft":
 				ev.preventDefault();
-				nextListItem = el.previousElementSibling;
+				nextListItem = sibling(el, false);
 				break;
 			case ev.key === "l":
 			case ev.key === "r":
@@ -220,8 +507,17 @@ document.addEventListener("DOMContentLoaded", ev => {
 				let deg = tfGetDegrees(rot[lightboxImage.dataset.id] ? rot[lightboxImage.dataset.id] : 0, ev.key);
 				rot[lightboxImage.dataset.id] = deg;
 				transform(true, lightboxImage.dataset.id);
+				if (document.body.dataset.rotate == "true") persistRotation(lightboxImage.dataset.id, ev.key == "r" ? 90 : 270);
+				break;
+			case ev.key === "f": // raw: full decode instead of the embedded preview
+				ev.preventDefault();
+				if (el.querySelector("img").dataset.ct == "raw") lightboxImage.src = imageSrc(lightboxImage.dataset.id, "&full=1");
 				break;
 			case /^F\d{1,2}$/.test(ev.key):
+			case ["Shift", "Control", "Alt", "Meta"].includes(ev.key):
+				break;
+			case metaKey(ev, [el]):
+			case ev.key === "a" && albumKey(ev, [el]):
 				break;
 			case ev.key === "+":
 				ev.preventDefault();
@@ -384,9 +680,64 @@ document.addEventListener("DOMContentLoaded", ev => {
 		localStorage.scheme = result ? "light" : "dark";
 	});
 
+	// directory tree (paged), children are loaded when expanded
+	const currentDir = (location.pathname.match(/^\/d\/(\d+)/) || [])[1];
+	let treeLoaded = false;
+
+	const treeItems = (parent, path, depth) => fetch(`/dirs?path=${encodeURIComponent(path)}`).then(res => res.json()).then(nodes => {
+		let after = parent;
+		nodes.forEach(n => {
+			const li = document.createElement("li");
+			li.className = "tree";
+			li.dataset.depth = depth;
+			li.style.paddingLeft = `${5 + depth * 16}px`;
+			if (n.id == currentDir) li.classList.add("active");
+
+			const toggle = document.createElement("span");
+			toggle.className = "toggle";
+			toggle.textContent = n.children ? "\u25b8 " : "\u00a0\u00a0";
+			li.append(toggle, n.name);
+
+			li.addEventListener("click", ev => {
+				if (n.children && (ev.target === toggle || n.id < 0)) {
+					expand(li, n, depth, toggle);
+					return;
+				}
+				location.href = `/d/${n.id}`;
+			});
+			if (after) after.after(li);
+			else document.getElementById('menuList').appendChild(li);
+			after = li;
+		});
+	});
+
+	const expand = (li, n, depth, toggle) => {
+		if (li.dataset.open) {
+			delete li.dataset.open;
+			toggle.textContent = "\u25b8 ";
+			while (li.nextElementSibling && li.nextElementSibling.dataset.depth > depth) li.nextElementSibling.remove();
+			return;
+		}
+		li.dataset.open = "1";
+		toggle.textContent = "\u25be ";
+		treeItems(li, n.path, depth + 1);
+	};
+
+	// previous / next directory or page
+	document.addEventListener("keydown", ev => {
+		if (lightbox.style.display === 'flex' || ev.target.tagName == "INPUT" || ev.target.tagName == "SELECT") return;
+		const rel = {"[": "prev", "]": "next"}[ev.key];
+		const a = rel && document.querySelector(`.nav a[rel=${rel}]`);
+		if (a) location.href = a.href;
+	});
+
 	// menu
 	document.getElementById('menu').addEventListener('click', () => {
 		const menuList = document.getElementById('menuList');
+		if (document.body.dataset.tree == "true" && !treeLoaded) {
+			treeLoaded = true;
+			treeItems(null, "", 0);
+		}
 		if (menuList.style.display === 'block') {
 			menuList.style.display = 'none';
 			document.getElementById('menuOverlay').style.display = 'none';
@@ -396,17 +747,98 @@ document.addEventListener("DOMContentLoaded", ev => {
 		}
 	});
 
-	(() => {
-		document.querySelectorAll('.dir-container').forEach(container => {
-			const listItem = document.createElement('li');
-			listItem.textContent = container.querySelector('span').textContent;
-			listItem.setAttribute('data-target', container.id);
-			listItem.addEventListener('click', (event) => {
-				menuList.style.display = 'none';
-				document.getElementById('menuOverlay').style.display = 'none';
-				document.getElementById(event.target.getAttribute('data-target')).scrollIntoView();
-			});
-			document.getElementById('menuList').appendChild(listItem);
+	// preset per client, stored in a cookie read by the server
+	document.querySelectorAll('.menu-list li.preset').forEach(item => {
+		item.addEventListener('click', () => {
+			document.cookie = `preset=${item.dataset.preset}; path=/; max-age=31536000; SameSite=Lax`;
+			document.querySelectorAll('.menu-list li.preset').forEach(li => li.classList.toggle('active', li === item));
+			menuList.style.display = 'none';
+			document.getElementById('menuOverlay').style.display = 'none';
+		});
+	});
+
+	document.querySelectorAll('.menu-list li.action').forEach(item => {
+		item.addEventListener('click', () => {
+			switch (item.dataset.action) {
+				case "select":
+					setSelecting(true);
+					break;
+				case "rating":
+					filter.rating = parseInt(item.dataset.value, 10);
+					applyFilter();
+					break;
+				case "label":
+					filter.label = item.dataset.value;
+					applyFilter();
+					break;
+				case "sort":
+					sortByRating(true);
+					break;
+				case "download":
+				case "download-resized":
+					download(shownIds(), item.dataset.action == "download-resized");
+					break;
+				case "clear":
+					filter = { rating: 0, label: "" };
+					applyFilter();
+					sortByRating(false);
+					break;
+			}
+			menuList.style.display = 'none';
+			document.getElementById('menuOverlay').style.display = 'none';
 		});
-	})();
+	});
+
+	const addDirItem = container => {
+		if (document.body.dataset.dirs != "true") return;
+		const listItem = document.createElement('li');
+		listItem.textContent = container.querySelector('span').textContent;
+		listItem.setAttribute('data-target', container.id);
+		listItem.addEventListener('click', (event) => {
+			menuList.style.display = 'none';
+			document.getElementById('menuOverlay').style.display = 'none';
+			document.getElementById(event.target.getAttribute('data-target')).scrollIntoView();
+		});
+		document.getElementById('menuList').appendChild(listItem);
+	};
+	document.querySelectorAll('.dir-container').forEach(addDirItem);
+
+	// indexing in progress: directories indexed since are appended, flat mode reloads once complete
+	const progress = document.getElementById("progress");
+	const poll = () => {
+		fetch(`/progress?from=${progress.dataset.from}`).then(res => res.json()).then(p => {
+			if (p.reload) {
+				location.reload();
+				return;
+			}
+			if (p.html) {
+				const tpl = document.createElement("template");
+				tpl.innerHTML = p.html;
+				const imgs = [...tpl.content.querySelectorAll("ul.flex li img")];
+				const dirs = [...tpl.content.querySelectorAll(".dir-container")];
+
+				// continue the last list if of the same kind
+				const lists = document.querySelectorAll("body > ul.flex, body > ul.stretch");
+				const last = lists[lists.length - 1];
+				const head = tpl.content.firstElementChild;
+				if (last && head && last.className == head.className) {
+					last.append(...head.children);
+					head.remove();
+				}
+				document.body.append(tpl.content);
+
+				imgs.forEach(initTile);
+				dirs.forEach(addDirItem);
+				applyFilter();
+			}
+			progress.dataset.from = p.next;
+			if (!p.indexing) {
+				progress.remove();
+				return;
+			}
+			progress.textContent = `Indexing: ${p.dirs} directories, ${p.files} files`;
+			setTimeout(poll, 1000);
+		}).catch(() => setTimeout(poll, 5000));
+	};
+	if (progress) setTimeout(poll, 1000);
 });
@@ -0,0 +1,108 @@
+/**
+ * thumbnailer :: slideshow
+ */
+
+document.addEventListener("DOMContentLoaded", ev => {
+	const slides = JSON.parse(document.getElementById("slides").textContent);
+	const interval = parseInt(document.body.dataset.interval, 10);
+	const params = new URLSearchParams(location.search);
+	const info = document.getElementById("slideInfo");
+
+	let front = document.getElementById("slideA");
+	let back = document.getElementById("slideB");
+	let pos = Math.max(0, parseInt(params.get("start") || "0", 10)) % Math.max(slides.length, 1);
+	let timer = null;
+	let paused = false;
+
+	if (!slides.length) {
+		info.textContent = "nothing to show";
+		info.style.opacity = 1;
+		return;
+	}
+
+	// keep a picked shuffle seed on reload
+	if (params.get("shuffle") && !params.get("seed")) {
+		params.set("seed", document.body.dataset.seed);
+		history.replaceState(null, "", `${location.pathname}?${params}`);
+	}
+
+	// same as the lightbox: viewport fit, preset per query (cookie otherwise)
+	const imageSrc = (id, retry=false) => {
+		const q = new URLSearchParams();
+		if (document.body.dataset.viewport == "true") {
+			q.set("vw", window.innerWidth);
+			q.set("vh", window.innerHeight);
+			q.set("dpr", window.devicePixelRatio || 1);
+		}
+		if (params.get("preset")) q.set("preset", params.get("preset"));
+		if (retry) q.set("retry", 1);
+		return q.toString() ? `/image/${id}?${q}` : `/image/${id}`;
+	};
+
+	const preload = (i) => {
+		const img = new Image();
+		img.src = imageSrc(slides[(i + slides.length) % slides.length]);
+	};
+
+	const show = (i) => {
+		clearTimeout(timer);
+		pos = (i + slides.length) % slides.length;
+		const id = slides[pos];
+
+		back.onload = () => {
+			back.onload = back.onerror = null;
+			back.classList.add("active");
+			front.classList.remove("active");
+			[front, back] = [back, front];
+
+			params.set("start", pos);
+			history.replaceState(null, "", `${location.pathname}?${params}`);
+			preload(pos + 1);
+			schedule();
+		};
+		back.onerror = () => { // one retry forcing a server-side decode, skipped otherwise
+			if (back.src.includes("retry=1")) {
+				back.onload = back.onerror = null;
+				show(pos + 1);
+				return;
+			}
+			back.src = imageSrc(id, true);
+		};
+		back.src = imageSrc(id);
+	};
+
+	const schedule = () => {
+		clearTimeout(timer);
+		if (!paused) timer = setTimeout(() => show(pos + 1), interval);
+	};
+
+	const flash = (text) => {
+		info.textContent = text;
+		info.style.opacity = 1;
+		setTimeout(() => { info.style.opacity = 0; }, 1500);
+	};
+
+	document.addEventListener("keydown", ev => {
+		switch (ev.key) {
+			case "ArrowRight":
+				show(pos + 1);
+				break;
+			case "ArrowLeft":
+				show(pos - 1);
+				break;
+			case " ":
+				ev.preventDefault();
+				paused = !paused;
+				flash(paused ? "paused" : "playing");
+				schedule();
+				break;
+			case "Escape":
+				location.href = "/";
+				break;
+		}
+	});
+
+	document.body.addEventListener("click", () => show(pos + 1));
+
+	show(pos);
+});
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// out-of-process decoding
+// the same binary is started with -worker and decodes jobs read from stdin,
+// so that a codec crashing on a malformed file takes down the worker only
+
+var (
+	errWorkerCrashed = errors.New("decoder crashed")
+	errDecodeTimeout = errors.New("decode timed out")
+	errWorkerStart   = errors.New("unable to start worker")
+	errQuarantined   = errors.New("quarantined")
+	errStaleIndex    = errors.New("index changed, reload the page")
+)
+
+type decodeJob struct {
+	Op        string // "thumbnail" | "image"
+	Path      string
+	CPage     int
+	Mpx       float64
+	Transcode int8
+	Opts      DecodeOpts
+}
+
+type decodeResult struct {
+	Buf       []byte
+	CT        string
+	CPage     int
+	Mpx       float64
+	Transcode int8
+	Err       string
+	Timings   []decodeTiming // -metrics
+	Embedded  int            // -fast, see workerEmbedded
+}
+
+type worker struct {
+	cmd  *exec.Cmd
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+	in   io.Closer
+	once sync.Once
+}
+
+type workerPool struct {
+	args []string
+	idle chan *worker // nil entries are started on demand
+}
+
+func newWorkerPool(size int, args []string) *workerPool {
+	p := &workerPool{args: args, idle: make(chan *worker, size)}
+	for i := 0; i < size; i++ {
+		p.idle <- nil
+	}
+	return p
+}
+
+func (p *workerPool) spawn() (*worker, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(exe, append([]string{"-worker"}, p.args...)...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &worker{cmd: cmd, enc: gob.NewEncoder(stdin), dec: gob.NewDecoder(stdout), in: stdin}, nil
+}
+
+func (w *worker) kill() {
+	w.once.Do(func() {
+		w.in.Close()
+		w.cmd.Process.Kill()
+		w.cmd.Wait()
+	})
+}
+
+// stops the idle workers, which exit once stdin is closed
+func (p *workerPool) close() {
+	for {
+		select {
+		case w := <-p.idle:
+			if w != nil {
+				w.in.Close()
+				w.cmd.Wait()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// runs the job on an idle worker; a crashed worker is replaced with a fresh one
+// an idle worker may have died meanwhile (ex. killed), the job is then retried once on a fresh one
+func (p *workerPool) run(job decodeJob, timeout time.Duration) (decodeResult, error) {
+	w := <-p.idle
+	retry := w != nil
+	for {
+		if w == nil {
+			var err error
+			if w, err = p.spawn(); err != nil {
+				p.idle <- nil
+				return decodeResult{}, fmt.Errorf("%w: %v", errWorkerStart, err)
+			}
+		}
+
+		res, sent, err := w.do(job, timeout)
+		if err != nil {
+			w.kill()
+			if !sent && retry {
+				w, retry = nil, false
+				continue
+			}
+			p.idle <- nil
+			return res, err
+		}
+		p.idle <- w
+
+		if res.Err != "" {
+			return res, errors.New(res.Err)
+		}
+		return res, nil
+	}
+}
+
+// sends the job and waits for the result; sent is false if the job didn't reach the worker
+// a worker exceeding the timeout (if any) is killed
+func (w *worker) do(job decodeJob, timeout time.Duration) (res decodeResult, sent bool, err error) {
+	var timedOut atomic.Bool
+	if timeout > 0 {
+		t := time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			w.kill()
+		})
+		defer t.Stop()
+	}
+
+	if err := w.enc.Encode(&job); err != nil {
+		if timedOut.Load() {
+			return res, true, errDecodeTimeout
+		}
+		return res, false, errWorkerCrashed
+	}
+	if err := w.dec.Decode(&res); err != nil {
+		if timedOut.Load() {
+			return res, true, errDecodeTimeout
+		}
+		return res, true, errWorkerCrashed
+	}
+	return res, true, nil
+}
+
+// worker mode main loop; exits once the parent closes stdin
+func runWorker() {
+	enc := gob.NewEncoder(os.Stdout)
+	dec := gob.NewDecoder(os.Stdin)
+
+	// ctrl+c reaches the whole process group; the parent drains and closes stdin
+	signal.Ignore(os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		var job decodeJob
+		if err := dec.Decode(&job); err != nil {
+			return
+		}
+
+		fi := FileInfo{isFile: true, Path: job.Path, cPage: job.CPage, mpx: job.Mpx, transcode: job.Transcode}
+		workerTimings, workerEmbedded = nil, 0
+
+		var res decodeResult
+		var err error
+		switch job.Op {
+		case "thumbnail":
+			res.Buf, res.CT, err = generateThumbnail(&fi, job.Opts)
+		case "image":
+			res.Buf, res.CT, err = loadImage(&fi, job.Opts)
+		default:
+			err = fmt.Errorf("unknown op: %s", job.Op)
+		}
+		if err != nil {
+			res.Err = err.Error()
+		}
+		res.CPage, res.Mpx, res.Transcode = fi.cPage, fi.mpx, fi.transcode
+		res.Timings, res.Embedded = workerTimings, workerEmbedded
+
+		if err := enc.Encode(&res); err != nil {
+			return
+		}
+	}
+}
+
+// keeps the page, size and transcode check learned by a decode in the index
+// unless the entry was swapped (SIGHUP) or renamed meanwhile
+func storeDecoded(id int, fi *FileInfo) {
+	indexMu.Lock()
+	if e := fileEntry(id); e != nil && e.Path == fi.Path {
+		e.cPage, e.mpx, e.transcode = fi.cPage, fi.mpx, fi.transcode
+	}
+	indexMu.Unlock()
+}
+
+// in-process decode of a copy of the entry (-timeout 0)
+// libvips and MuPDF can't be interrupted; a timeout requires the worker processes
+func decodeLocal(id int, fi FileInfo, op string, o DecodeOpts) ([]byte, string, error) {
+	defer sched.release()
+
+	var buf []byte
+	var ct string
+	var err error
+	if op == "thumbnail" {
+		buf, ct, err = generateThumbnail(&fi, o)
+	} else {
+		buf, ct, err = loadImage(&fi, o)
+	}
+	if err == nil {
+		storeDecoded(id, &fi)
+	}
+	return buf, ct, err
+}
+
+// schedules the decode and dispatches to the worker pool if enabled, in-process otherwise
+// failures are recorded in the quarantine list
+func decode(ctx context.Context, id int, op string, o DecodeOpts) ([]byte, string, error) {
+	fi, ok := indexedFile(id)
+	if !ok {
+		return nil, "", errStaleIndex
+	}
+	fp := fi.Path
+	if quarantine.blocked(fp) {
+		return nil, "", errQuarantined
+	}
+
+	if err := sched.acquire(ctx); err != nil {
+		return nil, "", err
+	}
+	// the index may have been swapped (SIGHUP) while waiting; it is stable while holding the slot
+	if fi, ok = indexedFile(id); !ok || fi.Path != fp {
+		sched.release()
+		return nil, "", errStaleIndex
+	}
+
+	var buf []byte
+	var ct string
+	var err error
+
+	if pool == nil {
+		buf, ct, err = decodeLocal(id, fi, op, o)
+	} else {
+		job := decodeJob{Op: op, Path: fp, CPage: fi.cPage, Mpx: fi.mpx, Transcode: fi.transcode, Opts: o}
+
+		var res decodeResult
+		res, err = pool.run(job, cfg.timeout)
+		for _, t := range res.Timings {
+			decodeTime.observe(t.Seconds, t.Format, t.Decoder)
+		}
+		if res.Embedded != 0 {
+			observeEmbedded(res.Embedded > 0)
+		}
+		if err == nil {
+			fi.cPage, fi.mpx, fi.transcode = res.CPage, res.Mpx, res.Transcode
+			storeDecoded(id, &fi)
+			buf, ct = res.Buf, res.CT
+		}
+		sched.release()
+	}
+
+	switch {
+	case err == nil:
+		decodes.inc(op, "ok")
+	case errors.Is(err, errWorkerCrashed), errors.Is(err, errDecodeTimeout):
+		result := "timeout"
+		if errors.Is(err, errWorkerCrashed) {
+			result = "crashed"
+		}
+		decodes.inc(op, result)
+		slog.Warn("decode failed", "op", op, "path", fp, "err", err)
+		quarantine.add(fp, err.Error(), true)
+	case errors.Is(err, errWorkerStart): // not the file's fault
+		decodes.inc(op, "error")
+		slog.Error("decode failed", "op", op, "path", fp, "err", err)
+	default:
+		decodes.inc(op, "error")
+		slog.Warn("decode failed", "op", op, "path", fp, "err", err)
+		quarantine.add(fp, err.Error(), false)
+	}
+	return buf, ct, err
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ratings, colour labels and tags (-xmp)
+// read from .xmp sidecars (file.ext.xmp or file.xmp) or embedded xmp (jpeg) at index time,
+// written to file.ext.xmp as darktable and digiKam do; other sidecar content is preserved
+
+const (
+	nsXmp = "http://ns.adobe.com/xap/1.0/"
+	nsDc  = "http://purl.org/dc/elements/1.1/"
+	nsRdf = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+var labels = []string{"red", "yellow", "green", "blue", "purple"}
+
+type xmpMeta struct {
+	Rating int      `json:"rating"`
+	Label  string   `json:"label"`
+	Tags   []string `json:"tags"`
+}
+
+// sidecar of fp, if any; names lists the entries of the directory (lowercase) to spare a stat per file
+func sidecarPath(fp string, names map[string]bool) string {
+	for _, sc := range sidecarNames(fp) {
+		if names == nil {
+			if _, err := os.Stat(sc); err == nil {
+				return sc
+			}
+		} else if names[strings.ToLower(filepath.Base(sc))] {
+			return sc
+		}
+	}
+	return ""
+}
+
+// file.ext.xmp (darktable, digiKam), file.xmp (lightroom)
+func sidecarNames(fp string) []string {
+	return []string{fp + ".xmp", strings.TrimSuffix(fp, filepath.Ext(fp)) + ".xmp"}
+}
+
+// file.ext.xmp of fp, if any; file.xmp may be shared by files of the same basename
+// (IMG_1.CR2, IMG_1.JPG) and is only read, never written, moved or trashed
+func ownSidecar(fp string) string {
+	sc := sidecarNames(fp)[0]
+	if _, err := os.Stat(sc); err != nil {
+		return ""
+	}
+	return sc
+}
+
+// carries the sidecar (if any) of a moved, copied or renamed file along
+func moveSidecar(from, to string, copy bool) error {
+	sc := ownSidecar(from)
+	if sc == "" {
+		return nil
+	}
+	dst := sidecarNames(to)[0]
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s exists", dst)
+	}
+	if copy {
+		return copyFile(sc, dst)
+	}
+	return os.Rename(sc, dst)
+}
+
+// metadata of fp, from its sidecar or embedded xmp
+func readMeta(fp string, names map[string]bool) xmpMeta {
+	if sc := sidecarPath(fp, names); sc != "" {
+		if buf, err := os.ReadFile(sc); err == nil {
+			return parseXmp(buf)
+		}
+	}
+	if ext := normExt(fp); ext == "jpg" || ext == "jpeg" {
+		if f, err := os.Open(fp); err == nil {
+			defer f.Close()
+			if buf, err := jpegXmp(f); err == nil {
+				return parseXmp(buf)
+			}
+		}
+	}
+	return xmpMeta{}
+}
+
+// xmp packet of a jpeg, from its app1 segment
+func jpegXmp(r io.ReaderAt) ([]byte, error) {
+	var b [4]byte
+	if _, err := r.ReadAt(b[:2], 0); err != nil || b[0] != 0xff || b[1] != 0xd8 {
+		return nil, errors.New("not a jpeg")
+	}
+
+	sig := []byte(nsXmp + "\x00")
+	pos := int64(2)
+	for i := 0; i < 32; i++ {
+		if _, err := r.ReadAt(b[:], pos); err != nil || b[0] != 0xff {
+			break
+		}
+		marker := b[1]
+		length := int64(binary.BigEndian.Uint16(b[2:]))
+
+		if marker == 0xe1 && length > int64(len(sig))+2 {
+			buf := make([]byte, length-2)
+			if _, err := r.ReadAt(buf, pos+4); err == nil && bytes.HasPrefix(buf, sig) {
+				return buf[len(sig):], nil
+			}
+		}
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		pos += 2 + length
+	}
+	return nil, errors.New("no xmp")
+}
+
+// rating, label and subject of an xmp packet, as attributes or elements of rdf:Description
+func parseXmp(buf []byte) xmpMeta {
+	var m xmpMeta
+	set := func(space, local, v string) {
+		v = strings.TrimSpace(v)
+		switch {
+		case space == nsXmp && local == "Rating":
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 && n <= 5 {
+				m.Rating = n
+			}
+		case space == nsXmp && local == "Label":
+			m.Label = strings.ToLower(v)
+		}
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	d.Strict = false
+	var path []xml.Name
+	var text strings.Builder
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space == nsRdf && t.Name.Local == "Description" {
+				for _, a := range t.Attr {
+					set(a.Name.Space, a.Name.Local, a.Value)
+				}
+			}
+			path = append(path, t.Name)
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(path) == 0 {
+				break
+			}
+			set(t.Name.Space, t.Name.Local, text.String())
+			// dc:subject/rdf:Bag/rdf:li
+			if t.Name.Space == nsRdf && t.Name.Local == "li" && len(path) >= 3 && path[len(path)-3].Space == nsDc && path[len(path)-3].Local == "subject" {
+				if tag := strings.TrimSpace(text.String()); tag != "" {
+					m.Tags = append(m.Tags, tag)
+				}
+			}
+			path = path[:len(path)-1]
+			text.Reset()
+		}
+	}
+	return m
+}
+
+const xmpTemplate = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="">
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+var (
+	reDescription = regexp.MustCompile(`<rdf:Description\b[^>]*?(/?)>`)
+	reSubject     = regexp.MustCompile(`(?s)\s*<dc:subject>.*?</dc:subject>|\s*<dc:subject\s*/>`)
+)
+
+// sets (or with v "" removes) xmp:{name} as attribute of rdf:Description, replacing an element form
+func setXmpProp(doc, name, v string) string {
+	attr := regexp.MustCompile(`\s*xmp:` + name + `\s*=\s*"[^"]*"`)
+	elem := regexp.MustCompile(`(?s)\s*<xmp:` + name + `>.*?</xmp:` + name + `>`)
+	doc = elem.ReplaceAllString(doc, "")
+
+	if v == "" {
+		return attr.ReplaceAllString(doc, "")
+	}
+	nv := fmt.Sprintf(` xmp:%s="%s"`, name, html.EscapeString(v))
+	if loc := attr.FindStringIndex(doc); loc != nil {
+		return doc[:loc[0]] + nv + doc[loc[1]:]
+	}
+	return insertAttr(doc, nv)
+}
+
+// inserts an attribute into the first rdf:Description
+func insertAttr(doc, attr string) string {
+	loc := reDescription.FindStringSubmatchIndex(doc)
+	if loc == nil {
+		return doc
+	}
+	end := loc[2] // before "/>" or ">"
+	return doc[:end] + attr + doc[end:]
+}
+
+// declares the xmp and dc namespaces on the first rdf:Description unless declared
+func declareNs(doc string) string {
+	if !strings.Contains(doc, `xmlns:xmp=`) {
+		doc = insertAttr(doc, ` xmlns:xmp="`+nsXmp+`"`)
+	}
+	if !strings.Contains(doc, `xmlns:dc=`) {
+		doc = insertAttr(doc, ` xmlns:dc="`+nsDc+`"`)
+	}
+	return doc
+}
+
+func setXmpSubject(doc string, tags []string) string {
+	doc = reSubject.ReplaceAllString(doc, "")
+	if len(tags) == 0 {
+		return doc
+	}
+
+	var b strings.Builder
+	b.WriteString("\n   <dc:subject>\n    <rdf:Bag>\n")
+	for _, t := range tags {
+		fmt.Fprintf(&b, "     <rdf:li>%s</rdf:li>\n", html.EscapeString(t))
+	}
+	b.WriteString("    </rdf:Bag>\n   </dc:subject>")
+
+	loc := reDescription.FindStringSubmatchIndex(doc)
+	if loc == nil {
+		return doc
+	}
+	if loc[3] > loc[2] { // self-closing, open it
+		return doc[:loc[2]] + ">" + b.String() + "\n  </rdf:Description>" + doc[loc[1]:]
+	}
+	return doc[:loc[1]] + b.String() + doc[loc[1]:]
+}
+
+// writes m to file.ext.xmp, creating it if needed; a file.xmp sidecar serves as the template
+func writeMeta(fp string, m xmpMeta) error {
+	sc := sidecarNames(fp)[0]
+	src := sidecarPath(fp, nil)
+	if src == "" {
+		src = sc
+	}
+
+	doc := xmpTemplate
+	if buf, err := os.ReadFile(src); err == nil {
+		doc = string(buf)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if reDescription.FindStringIndex(doc) == nil {
+		return fmt.Errorf("%s: no rdf:Description", src)
+	}
+
+	doc = declareNs(doc)
+	rating := ""
+	if m.Rating > 0 { rating = strconv.Itoa(m.Rating) }
+	doc = setXmpProp(doc, "Rating", rating)
+	label := ""
+	if m.Label != "" { label = strings.ToUpper(m.Label[:1]) + m.Label[1:] } // Red, Yellow, ..
+	doc = setXmpProp(doc, "Label", label)
+	doc = setXmpSubject(doc, m.Tags)
+
+	return writeFileAtomic(sc, []byte(doc), 0644)
+}
+
+// partial update of the metadata of a file
+type metaRequest struct {
+	Rating *int      `json:"rating"`
+	Label  *string   `json:"label"`
+	Tags   *[]string `json:"tags"`
+}
+
+// POST /meta/{id}
+func metaHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkPost(w, r) {
+		return
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/meta/"))
+
+	var req metaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	fi := fileEntry(id)
+	if fi == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	m := xmpMeta{Rating: fi.rating, Label: fi.label, Tags: fi.tags}
+	if req.Rating != nil {
+		if *req.Rating < 0 || *req.Rating > 5 {
+			http.Error(w, "Invalid rating", http.StatusBadRequest)
+			return
+		}
+		m.Rating = *req.Rating
+	}
+	if req.Label != nil {
+		if *req.Label != "" && !validLabel(*req.Label) {
+			http.Error(w, "Invalid label", http.StatusBadRequest)
+			return
+		}
+		m.Label = *req.Label
+	}
+	if req.Tags != nil {
+		m.Tags = nil
+		for _, t := range *req.Tags {
+			if t = strings.TrimSpace(t); t != "" {
+				m.Tags = append(m.Tags, t)
+			}
+		}
+	}
+
+	if err := writeMeta(fi.Path, m); err != nil {
+		http.Error(w, "Unable to write sidecar: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fi.rating, fi.label, fi.tags = m.Rating, m.Label, m.Tags
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// tile attributes for filtering and sorting, none without -xmp
+func metaAttrs(itm FileInfo) string {
+	if !cfg.xmp {
+		return ""
+	}
+	return fmt.Sprintf(` data-rating="%d" data-label="%s" data-tags="%s"`, itm.rating, html.EscapeString(itm.label), html.EscapeString(strings.Join(itm.tags, ", ")))
+}
+
+func validLabel(l string) bool {
+	for _, v := range labels {
+		if v == l {
+			return true
+		}
+	}
+	return false
+}